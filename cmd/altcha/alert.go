@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/joho/godotenv"
+
+	"altcha/pkg/alert"
+	"altcha/pkg/config"
+)
+
+func alertTest(args []string) error {
+	fs := flag.NewFlagSet("alert-test", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), "Usage: altcha alert-test [flags]\n\n"+
+			"Validates an alert rules file and sends a test notification to its\n"+
+			"notifiers. The file defaults to ALERT_RULES_FILE, read like the dashboard\n"+
+			"reads it (environment, CONFIG_FILE, .env).\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	path := fs.String("rules", "", "rules file (overrides ALERT_RULES_FILE)")
+	notifiers := fs.String("notifier", "", "comma-separated notifiers to test (default all)")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	_ = godotenv.Load()
+	if *path == "" {
+		cfg, err := config.Load()
+		if err != nil {
+			return err
+		}
+		*path = cfg.AlertRulesFile
+	}
+	if *path == "" {
+		return errors.New("no rules file: set ALERT_RULES_FILE or pass -rules")
+	}
+
+	f, err := alert.LoadFile(*path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d rules and %d notifiers are valid\n", len(f.Rules), len(f.Notifiers))
+
+	var names []string
+	if *notifiers != "" {
+		names = strings.Split(*notifiers, ",")
+	}
+	if err := alert.SendTest(context.Background(), f, names); err != nil {
+		return err
+	}
+	fmt.Println("Test notifications sent")
+	return nil
+}
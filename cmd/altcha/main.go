@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `Usage: altcha <command> [flags]
+
+Commands:
+  solve       Fetch a challenge, solve it and print the payload
+  migrate     Apply pending analytics schema migrations
+  purge-ips   Anonymize the client IPs of recorded analytics events
+  alert-test  Validate the alert rules and send test notifications
+
+Run "altcha <command> -h" for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "solve":
+		err = solve(os.Args[2:])
+	case "migrate":
+		err = migrate(os.Args[2:])
+	case "purge-ips":
+		err = purgeIPs(os.Args[2:])
+	case "alert-test":
+		err = alertTest(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "altcha: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "altcha %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	"altcha/pkg/analytics"
+	"altcha/pkg/config"
+)
+
+func migrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), "Usage: altcha migrate [flags]\n\n"+
+			"Applies the pending analytics schema migrations. The database URL is read\n"+
+			"like the server reads it (POSTGRES_URL, POSTGRES_URL_FILE, CONFIG_FILE, .env).\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	url := fs.String("url", "", "PostgreSQL connection URL (overrides POSTGRES_URL)")
+	status := fs.Bool("status", false, "list the migrations and whether they are applied, without applying")
+	timeout := fs.Duration("timeout", 10*time.Minute, "time budget including waiting for the migration lock, 0 for none")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	dsn := *url
+	if dsn == "" {
+		_ = godotenv.Load()
+		cfg, err := config.Load()
+		if err != nil {
+			return err
+		}
+		dsn = cfg.PostgresURL
+	}
+	if dsn == "" {
+		return errors.New("no database: set POSTGRES_URL or pass -url")
+	}
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	db := analytics.OpenDB(func() string { return dsn })
+	defer db.Close()
+
+	if *status {
+		ms, err := analytics.Migrations(ctx, db)
+		if err != nil {
+			return err
+		}
+		for _, m := range ms {
+			state := "pending"
+			if !m.AppliedAt.IsZero() {
+				state = "applied " + m.AppliedAt.Local().Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-24s %s\n", m.Version, m.Name, state)
+		}
+		return nil
+	}
+
+	done, err := analytics.Migrate(ctx, db)
+	for _, m := range done {
+		fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(done) == 0 {
+		fmt.Println("schema is up to date")
+	}
+	return nil
+}
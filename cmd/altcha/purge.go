@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	"altcha/pkg/analytics"
+	"altcha/pkg/config"
+)
+
+func purgeIPs(args []string) error {
+	fs := flag.NewFlagSet("purge-ips", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), "Usage: altcha purge-ips [flags]\n\n"+
+			"Rewrites the client IPs of recorded analytics events with an IP mode, e.g.\n"+
+			"after switching ANALYTICS_IP_MODE. Settings are read like the server reads\n"+
+			"them (environment, CONFIG_FILE, .env). Runs can be interrupted and repeated.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	mode := fs.String("mode", "", "truncate, hash or drop (default ANALYTICS_IP_MODE)")
+	before := fs.String("before", "", "only events before this date (YYYY-MM-DD, UTC) or RFC 3339 time (default now)")
+	url := fs.String("url", "", "PostgreSQL connection URL (overrides POSTGRES_URL)")
+	sqlitePath := fs.String("sqlite", "", "purge this SQLite sink file instead of PostgreSQL")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	_ = godotenv.Load()
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+
+	// Salts of this run are new and dropped on exit, like the server's.
+	policy := analytics.IPPolicy{Mode: cfg.AnalyticsIPMode, SaltPeriod: cfg.AnalyticsIPSaltPeriod(), Salts: &analytics.IPSalts{}}
+	if *mode != "" {
+		policy.Mode = *mode
+	}
+	switch policy.Mode {
+	case analytics.IPTruncate, analytics.IPHash, analytics.IPDrop:
+	default:
+		return fmt.Errorf("mode must be truncate, hash or drop, not %q", policy.Mode)
+	}
+
+	until := time.Now()
+	if *before != "" {
+		if t, err := time.Parse(time.RFC3339, *before); err == nil {
+			until = t
+		} else if t, err := time.Parse("2006-01-02", *before); err == nil {
+			until = t
+		} else {
+			return fmt.Errorf("invalid -before %q", *before)
+		}
+	}
+
+	ctx := context.Background()
+	var n int64
+	if *sqlitePath != "" {
+		sink, err := analytics.NewSQLiteSink(*sqlitePath)
+		if err != nil {
+			return err
+		}
+		defer sink.Close()
+		n, err = sink.PurgeIPs(ctx, policy, until)
+		if err != nil {
+			return fmt.Errorf("after %d rows: %w", n, err)
+		}
+	} else {
+		dsn := *url
+		if dsn == "" {
+			dsn = cfg.PostgresURL
+		}
+		if dsn == "" {
+			return errors.New("no database: set POSTGRES_URL, pass -url or -sqlite")
+		}
+		db := analytics.OpenDB(func() string { return dsn })
+		defer db.Close()
+		n, err = analytics.PurgeIPs(ctx, db, policy, until)
+		if err != nil {
+			return fmt.Errorf("after %d rows: %w", n, err)
+		}
+	}
+	fmt.Printf("%d events rewritten with IP mode %s\n", n, policy.Mode)
+	return nil
+}
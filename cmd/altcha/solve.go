@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"altcha/pkg/solver"
+)
+
+func solve(args []string) error {
+	fs := flag.NewFlagSet("solve", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), "Usage: altcha solve [flags] [challenge-url]\n\n"+
+			"Fetches a challenge (default http://localhost:3000/challenge), solves it\n"+
+			"and prints the base64 payload to stdout.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	workers := fs.Int("workers", 0, "solver goroutines (default number of CPUs)")
+	maxTime := fs.Duration("max-time", 30*time.Second, "time budget for fetching and solving, 0 for none")
+	verbose := fs.Bool("v", false, "print the solution number and solve time to stderr")
+	fs.Parse(args)
+
+	url := "http://localhost:3000/challenge"
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		url = fs.Arg(0)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	payload, sol, err := solver.SolveURL(context.Background(), url, solver.Options{
+		Workers:    *workers,
+		MaxTime:    *maxTime,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	})
+	if err != nil {
+		return err
+	}
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "number=%d took=%s\n", sol.Number, sol.Took.Round(time.Millisecond))
+	}
+	fmt.Println(payload)
+	return nil
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
-	"database/sql"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
+	_ "time/tzdata" // IANA zones for ?tz= on images without zoneinfo
 
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
 
+	"altcha/pkg/alert"
+	"altcha/pkg/analytics"
 	"altcha/pkg/config"
 	"altcha/pkg/dashboard"
 )
@@ -17,10 +18,14 @@ import (
 func main() {
 	_ = godotenv.Load()
 
-	cfg := config.Load()
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Printf("[DASHBOARD]: Invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
 
-	if cfg.PostgresURL == "" {
-		fmt.Println("[DASHBOARD]: POSTGRES_URL is required")
+	if cfg.DashboardSource == "postgres" && cfg.PostgresURL == "" {
+		fmt.Println("[DASHBOARD]: POSTGRES_URL is required (or set DASHBOARD_SOURCE=sqlite)")
 		os.Exit(1)
 	}
 	if cfg.AuthProvider == "" {
@@ -28,19 +33,50 @@ func main() {
 		os.Exit(1)
 	}
 
-	db, err := sql.Open("postgres", cfg.PostgresURL)
-	if err != nil {
-		fmt.Printf("[DASHBOARD]: Failed to connect to postgres: %v\n", err)
-		os.Exit(1)
+	holder := config.NewHolder(cfg)
+
+	var src analytics.Source
+	var live *analytics.LiveFeed
+	if cfg.DashboardSource == "sqlite" {
+		sqlite, err := analytics.NewSQLiteSource(cfg.AnalyticsSQLitePath)
+		if err != nil {
+			fmt.Printf("[DASHBOARD]: Failed to open %s: %v\n", cfg.AnalyticsSQLitePath, err)
+			os.Exit(1)
+		}
+		defer sqlite.Close()
+		src = sqlite
+		live = sqlite.Live()
+		fmt.Printf("[DASHBOARD]: Reading analytics from %s\n", cfg.AnalyticsSQLitePath)
+	} else {
+		db := analytics.OpenDB(func() string { return holder.Get().PostgresURL })
+		defer db.Close()
+
+		if err := db.Ping(); err != nil {
+			fmt.Printf("[DASHBOARD]: Failed to ping postgres: %v\n", err)
+			os.Exit(1)
+		}
+		src = analytics.NewPostgresSource(db)
+
+		live, err = analytics.ListenLive(func() string { return holder.Get().PostgresURL })
+		if err != nil {
+			fmt.Printf("[DASHBOARD]: Failed to listen for live events: %v\n", err)
+			os.Exit(1)
+		}
 	}
-	defer db.Close()
+	defer live.Close()
 
-	if err := db.Ping(); err != nil {
-		fmt.Printf("[DASHBOARD]: Failed to ping postgres: %v\n", err)
-		os.Exit(1)
+	if cfg.AlertRulesFile != "" {
+		rules, err := alert.LoadFile(cfg.AlertRulesFile)
+		if err != nil {
+			fmt.Printf("[DASHBOARD]: Invalid alert rules:\n%v\n", err)
+			os.Exit(1)
+		}
+		engine := alert.NewEngine(rules, src)
+		defer engine.Close()
+		fmt.Printf("[DASHBOARD]: Evaluating %d alert rules every %s\n", len(rules.Rules), rules.Interval)
 	}
 
-	srv, err := dashboard.NewServer(cfg, db)
+	srv, err := dashboard.NewServer(holder, src, live)
 	if err != nil {
 		fmt.Printf("[DASHBOARD]: Failed to create server: %v\n", err)
 		os.Exit(1)
@@ -54,9 +90,33 @@ func main() {
 		}
 	}()
 
+	go reloadOnHangup(holder)
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
 	fmt.Println("[DASHBOARD]: Shutting down...")
 }
+
+// reloadOnHangup reloads the configuration (including _FILE secrets) on every
+// SIGHUP. An invalid configuration is logged and the current one is kept.
+func reloadOnHangup(holder *config.Holder) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		changes, err := holder.Reload()
+		if err != nil {
+			fmt.Printf("[DASHBOARD]: Reload rejected, keeping current configuration:\n%v\n", err)
+			continue
+		}
+		if len(changes) == 0 {
+			fmt.Println("[DASHBOARD]: Configuration reloaded: no changes")
+			continue
+		}
+		fmt.Println("[DASHBOARD]: Configuration reloaded:")
+		for _, c := range changes {
+			fmt.Printf("  %s\n", c)
+		}
+	}
+}
@@ -4,12 +4,19 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 
+	"altcha/pkg/access"
+	"altcha/pkg/admin"
 	"altcha/pkg/analytics"
+	"altcha/pkg/apikey"
 	"altcha/pkg/config"
+	"altcha/pkg/gate"
+	"altcha/pkg/health"
 	"altcha/pkg/server"
 	"altcha/pkg/store"
 )
@@ -17,9 +24,19 @@ import (
 func main() {
 	_ = godotenv.Load()
 
-	cfg := config.Load()
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Printf("[ALTCHA]: Invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+	if err := cfg.CheckSecret(); err != nil {
+		fmt.Printf("[ALTCHA]: %v\n", err)
+		os.Exit(1)
+	}
+
+	holder := config.NewHolder(cfg)
 
-	s, err := initStore(cfg)
+	s, err := initStore(holder)
 	if err != nil {
 		fmt.Printf("[ALTCHA]: Failed to initialize store (%s): %v\n", cfg.Store, err)
 		os.Exit(1)
@@ -28,18 +45,68 @@ func main() {
 
 	fmt.Printf("[ALTCHA]: Using %s store\n", cfg.Store)
 
+	var geoip *analytics.GeoIP
+	if cfg.GeoIPDB != "" || cfg.GeoIPASNDB != "" || cfg.GeoIPCityDB != "" {
+		geoip, err = analytics.NewGeoIP(cfg.GeoIPDB, cfg.GeoIPASNDB, cfg.GeoIPCityDB)
+		if err != nil {
+			fmt.Printf("[ALTCHA]: Failed to open GeoIP database: %v\n", err)
+			os.Exit(1)
+		}
+		defer geoip.Close()
+	}
+
 	var collector *analytics.Collector
 	if cfg.AnalyticsEnabled() {
-		collector, err = analytics.NewCollector(cfg.PostgresURL, cfg.GeoIPDB)
+		var sinks []analytics.Sink
+		for _, name := range cfg.AnalyticsSinks {
+			sink, err := initSink(holder, name)
+			if err != nil {
+				fmt.Printf("[ALTCHA]: Failed to initialize analytics sink %s: %v\n", name, err)
+				os.Exit(1)
+			}
+			sinks = append(sinks, sink)
+
+			if pg, ok := sink.(*analytics.PostgresSink); ok {
+				maintainer := analytics.NewMaintainer(pg.DB(), func() time.Duration { return holder.Get().AnalyticsRetention() })
+				defer maintainer.Close()
+			}
+		}
+		salts := &analytics.IPSalts{}
+		collector = analytics.NewCollector(analytics.FanOut(sinks...), geoip, func() analytics.IPPolicy {
+			cfg := holder.Get()
+			return analytics.IPPolicy{Mode: cfg.AnalyticsIPMode, SaltPeriod: cfg.AnalyticsIPSaltPeriod(), Salts: salts}
+		})
+		defer collector.Close()
+		fmt.Printf("[ALTCHA]: Analytics enabled (%s, client IPs: %s)\n", strings.Join(cfg.AnalyticsSinks, ", "), cfg.AnalyticsIPMode)
+	}
+
+	var keys *apikey.Keyring
+	if cfg.VerifyAPIKeysFile != "" {
+		keys, err = apikey.LoadFile(cfg.VerifyAPIKeysFile)
 		if err != nil {
-			fmt.Printf("[ALTCHA]: Failed to initialize analytics: %v\n", err)
+			fmt.Printf("[ALTCHA]: Failed to load verify API keys: %v\n", err)
 			os.Exit(1)
 		}
-		defer collector.Close()
-		fmt.Println("[ALTCHA]: Analytics enabled (PostgreSQL)")
+		fmt.Println("[ALTCHA]: /verify requires an API key")
+	}
+
+	list, err := access.NewList(holder, geoip)
+	if err != nil {
+		fmt.Printf("[ALTCHA]: Failed to initialize access rules: %v\n", err)
+		os.Exit(1)
+	}
+
+	checker := health.NewChecker()
+	checker.Add("store", true, health.Store(s))
+	checker.Add("verify", true, health.Verify(holder))
+	if collector != nil {
+		checker.Add("analytics", false, collector.Ping)
+	}
+	if geoip != nil {
+		checker.Add("geoip", false, health.GeoIP(geoip))
 	}
 
-	apiServer := server.NewAPIServer(cfg, s, collector)
+	apiServer := server.NewAPIServer(holder, s, collector, keys, list, checker)
 	go func() {
 		addr := fmt.Sprintf("0.0.0.0:%d", cfg.Port)
 		fmt.Printf("[ALTCHA]: Captcha Server is running at http://localhost:%d\n", cfg.Port)
@@ -48,8 +115,58 @@ func main() {
 		}
 	}()
 
+	if cfg.InternalEnabled() {
+		internalServer := server.NewInternalServer(holder, s, collector, keys, list, checker)
+		go func() {
+			addr := fmt.Sprintf("0.0.0.0:%d", cfg.InternalPort)
+			fmt.Printf("[ALTCHA]: Internal Server (/verify, /health) is running at http://localhost:%d\n", cfg.InternalPort)
+			if err := internalServer.Start(addr); err != nil {
+				fmt.Printf("[ALTCHA]: Internal server stopped: %v\n", err)
+			}
+		}()
+	}
+
+	if cfg.AdminEnabled() {
+		adminKeys, err := apikey.LoadFile(cfg.AdminAPIKeysFile)
+		if err != nil {
+			fmt.Printf("[ALTCHA]: Failed to load admin API keys: %v\n", err)
+			os.Exit(1)
+		}
+		audit, err := admin.NewAuditor(cfg.AdminAuditLog)
+		if err != nil {
+			fmt.Printf("[ALTCHA]: Failed to open audit log: %v\n", err)
+			os.Exit(1)
+		}
+		defer audit.Close()
+
+		adminServer := server.NewAdminServer(holder, admin.New(holder, s, list), adminKeys, audit)
+		go func() {
+			addr := fmt.Sprintf("0.0.0.0:%d", cfg.AdminPort)
+			fmt.Printf("[ALTCHA]: Admin API is running at http://localhost:%d\n", cfg.AdminPort)
+			if err := adminServer.Start(addr); err != nil {
+				fmt.Printf("[ALTCHA]: Admin server stopped: %v\n", err)
+			}
+		}()
+	}
+
+	if cfg.GateEnabled() {
+		g, err := gate.New(holder, s)
+		if err != nil {
+			fmt.Printf("[ALTCHA]: Failed to initialize gate: %v\n", err)
+			os.Exit(1)
+		}
+		gateServer := server.NewGateServer(holder, g, list)
+		go func() {
+			addr := fmt.Sprintf("0.0.0.0:%d", cfg.GatePort)
+			fmt.Printf("[ALTCHA]: Gate is running at http://localhost:%d (upstream %s)\n", cfg.GatePort, cfg.GateUpstream)
+			if err := gateServer.Start(addr); err != nil {
+				fmt.Printf("[ALTCHA]: Gate server stopped: %v\n", err)
+			}
+		}()
+	}
+
 	if cfg.Demo {
-		demoServer := server.NewDemoServer(cfg)
+		demoServer := server.NewDemoServer(holder, s)
 		go func() {
 			addr := fmt.Sprintf("0.0.0.0:%d", cfg.DemoPort)
 			fmt.Printf("[ALTCHA]: Captcha Test Server is running at http://localhost:%d\n", cfg.DemoPort)
@@ -59,6 +176,8 @@ func main() {
 		}()
 	}
 
+	go reloadOnHangup(holder)
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
@@ -66,13 +185,52 @@ func main() {
 	fmt.Println("[ALTCHA]: Shutting down...")
 }
 
-func initStore(cfg *config.Config) (store.Store, error) {
+// reloadOnHangup reloads the configuration (including _FILE secrets) on every
+// SIGHUP. An invalid configuration is logged and the current one is kept.
+func reloadOnHangup(holder *config.Holder) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		changes, err := holder.Reload()
+		if err != nil {
+			fmt.Printf("[ALTCHA]: Reload rejected, keeping current configuration:\n%v\n", err)
+			continue
+		}
+		if len(changes) == 0 {
+			fmt.Println("[ALTCHA]: Configuration reloaded: no changes")
+			continue
+		}
+		fmt.Println("[ALTCHA]: Configuration reloaded:")
+		for _, c := range changes {
+			fmt.Printf("  %s\n", c)
+		}
+	}
+}
+
+func initStore(holder *config.Holder) (store.Store, error) {
+	cfg := holder.Get()
 	switch cfg.Store {
 	case "sqlite":
 		return store.NewSQLiteStore(cfg.SQLitePath, cfg.MaxRecords)
 	case "redis":
-		return store.NewRedisStore(cfg.RedisURL, cfg.RedisCluster, cfg.ExpireMinutes)
+		return store.NewRedisStore(func() string { return holder.Get().RedisURL }, cfg.RedisCluster, cfg.ExpireMinutes)
 	default:
 		return store.NewMemoryStore(cfg.MaxRecords), nil
 	}
 }
+
+func initSink(holder *config.Holder, name string) (analytics.Sink, error) {
+	cfg := holder.Get()
+	switch name {
+	case "postgres":
+		return analytics.NewPostgresSink(func() string { return holder.Get().PostgresURL }, cfg.AnalyticsAutoMigrate)
+	case "sqlite":
+		return analytics.NewSQLiteSink(cfg.AnalyticsSQLitePath)
+	case "live":
+		return analytics.NewLiveSink(func() string { return holder.Get().PostgresURL })
+	case "file":
+		return analytics.NewFileSink(cfg.AnalyticsFilePath, int64(cfg.AnalyticsFileMaxMB)<<20, cfg.AnalyticsFileMaxBackups)
+	default:
+		return analytics.NewWriterSink(os.Stdout), nil
+	}
+}
@@ -0,0 +1,329 @@
+// Package access applies allow/deny rules by IP, CIDR, country or ASN before
+// clients reach /challenge or the gate's challenge and clearance, and block
+// rules before /forward-auth.
+package access
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"altcha/pkg/analytics"
+	"altcha/pkg/config"
+	"altcha/pkg/handler"
+)
+
+// Actions, from weakest to strongest. An allow rule exempts the client from
+// every other rule; otherwise the strongest matching action wins.
+const (
+	ActionAllow = "allow"
+	ActionTag   = "tag"   // record the match in analytics only
+	ActionRaise = "raise" // multiply COMPLEXITY by ACCESS_RAISE_FACTOR
+	ActionBlock = "block" // 403
+)
+
+const (
+	TypeIP      = "ip"
+	TypeCIDR    = "cidr"
+	TypeCountry = "country"
+	TypeASN     = "asn"
+)
+
+const (
+	SourceConfig  = "config"
+	SourceRuntime = "runtime"
+)
+
+var (
+	ErrNoCountryDB = errors.New("country rules require GEOIP_DB")
+	ErrNoASNDB     = errors.New("ASN rules require GEOIP_ASN_DB")
+)
+
+var strength = map[string]int{ActionTag: 1, ActionRaise: 2, ActionBlock: 3}
+
+type Rule struct {
+	Action string     `json:"action"`
+	Type   string     `json:"type"`
+	Value  string     `json:"value"`
+	Source string     `json:"source"`
+	Added  *time.Time `json:"added,omitempty"`
+
+	prefix netip.Prefix
+	asn    uint
+}
+
+func (r Rule) String() string {
+	return r.Action + " " + r.Value
+}
+
+// Decision is the outcome for one client. Action is empty when no rule
+// matched.
+type Decision struct {
+	Action string
+	Rule   string
+}
+
+// List holds the static rules from ACCESS_RULES and rules added at runtime
+// through the admin API.
+type List struct {
+	config *config.Holder
+	geoip  *analytics.GeoIP
+	static []Rule
+
+	mu      sync.RWMutex
+	runtime map[string]Rule // by value
+}
+
+// NewList parses ACCESS_RULES. geoip may be nil, in which case country and
+// ASN rules are rejected.
+func NewList(h *config.Holder, geoip *analytics.GeoIP) (*List, error) {
+	l := &List{config: h, geoip: geoip, runtime: make(map[string]Rule)}
+	for _, s := range h.Get().AccessRules {
+		if s == "" {
+			continue
+		}
+		action, value, ok := strings.Cut(strings.TrimSpace(s), " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid ACCESS_RULES entry %q (want \"<action> <value>\")", s)
+		}
+		r, err := l.parse(action, value)
+		if err != nil {
+			return nil, fmt.Errorf("ACCESS_RULES: %w", err)
+		}
+		r.Source = SourceConfig
+		l.static = append(l.static, r)
+	}
+	return l, nil
+}
+
+// Add adds or replaces a runtime rule for value.
+func (l *List) Add(action, value string) (Rule, error) {
+	r, err := l.parse(action, value)
+	if err != nil {
+		return Rule{}, err
+	}
+	now := time.Now().UTC()
+	r.Source, r.Added = SourceRuntime, &now
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.runtime[r.Value] = r
+	return r, nil
+}
+
+// Remove deletes the runtime rule for value and reports whether it existed.
+// Rules from ACCESS_RULES cannot be removed.
+func (l *List) Remove(value string) (bool, error) {
+	_, v, err := parseValue(value)
+	if err != nil {
+		return false, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.runtime[v]; !ok {
+		return false, nil
+	}
+	delete(l.runtime, v)
+	return true, nil
+}
+
+// Rules returns the static rules followed by the runtime rules in the order
+// they were added.
+func (l *List) Rules() []Rule {
+	l.mu.RLock()
+	runtime := make([]Rule, 0, len(l.runtime))
+	for _, r := range l.runtime {
+		runtime = append(runtime, r)
+	}
+	l.mu.RUnlock()
+
+	sort.Slice(runtime, func(i, j int) bool { return runtime[i].Added.Before(*runtime[j].Added) })
+	return append(append([]Rule{}, l.static...), runtime...)
+}
+
+// Check evaluates every rule against ip.
+func (l *List) Check(ip string) Decision {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return Decision{}
+	}
+	addr = addr.Unmap().WithZone("")
+
+	rules := l.static
+	l.mu.RLock()
+	if len(l.runtime) > 0 {
+		rules = make([]Rule, 0, len(l.static)+len(l.runtime))
+		rules = append(rules, l.static...)
+		for _, r := range l.runtime {
+			rules = append(rules, r)
+		}
+	}
+	l.mu.RUnlock()
+
+	m := matcher{geoip: l.geoip, ip: ip, addr: addr}
+	var best Rule
+	for _, r := range rules {
+		if !m.match(r) {
+			continue
+		}
+		if r.Action == ActionAllow {
+			return Decision{Action: ActionAllow, Rule: r.String()}
+		}
+		if strength[r.Action] > strength[best.Action] {
+			best = r
+		}
+	}
+	if best.Action == "" {
+		return Decision{}
+	}
+	return Decision{Action: best.Action, Rule: best.String()}
+}
+
+// matcher looks up the country and ASN of one client at most once.
+type matcher struct {
+	geoip *analytics.GeoIP
+	ip    string
+	addr  netip.Addr
+
+	country   *string
+	asn       uint
+	looked    bool
+	lookedASN bool
+}
+
+func (m *matcher) match(r Rule) bool {
+	switch r.Type {
+	case TypeIP, TypeCIDR:
+		return r.prefix.Contains(m.addr)
+	case TypeCountry:
+		if !m.looked {
+			m.country, _ = m.geoip.Lookup(m.ip)
+			m.looked = true
+		}
+		return m.country != nil && *m.country == r.Value
+	case TypeASN:
+		if !m.lookedASN {
+			m.asn, _ = m.geoip.ASN(m.ip)
+			m.lookedASN = true
+		}
+		return m.asn != 0 && m.asn == r.asn
+	}
+	return false
+}
+
+// Middleware applies the decision for the client: block answers 403, raise
+// increases the challenge complexity, and every match is recorded in
+// analytics.
+func Middleware(l *List) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			d := l.Check(c.RealIP())
+			if d.Action == "" {
+				return next(c)
+			}
+			c.Set(analytics.ContextAccessAction, d.Action)
+			c.Set(analytics.ContextAccessRule, d.Rule)
+
+			switch d.Action {
+			case ActionBlock:
+				return c.NoContent(http.StatusForbidden)
+			case ActionRaise:
+				c.Set(handler.ContextComplexityFactor, l.config.Get().AccessRaiseFactor)
+			}
+			return next(c)
+		}
+	}
+}
+
+// BlockMiddleware only enforces block rules, for /forward-auth: the client
+// IP comes from X-Forwarded-For of a proxy in TRUSTED_PROXIES, and there is
+// no challenge to raise. Other matches are recorded in analytics.
+func BlockMiddleware(l *List) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			d := l.Check(c.RealIP())
+			if d.Action == "" {
+				return next(c)
+			}
+			c.Set(analytics.ContextAccessAction, d.Action)
+			c.Set(analytics.ContextAccessRule, d.Rule)
+			if d.Action == ActionBlock {
+				return c.NoContent(http.StatusForbidden)
+			}
+			return next(c)
+		}
+	}
+}
+
+func (l *List) parse(action, value string) (Rule, error) {
+	action = strings.ToLower(strings.TrimSpace(action))
+	if _, ok := strength[action]; !ok && action != ActionAllow {
+		return Rule{}, fmt.Errorf("%q is not an action (allow, block, raise or tag)", action)
+	}
+
+	typ, v, err := parseValue(value)
+	if err != nil {
+		return Rule{}, err
+	}
+	r := Rule{Action: action, Type: typ, Value: v}
+	switch typ {
+	case TypeIP:
+		addr := netip.MustParseAddr(v)
+		r.prefix = netip.PrefixFrom(addr, addr.BitLen())
+	case TypeCIDR:
+		r.prefix = netip.MustParsePrefix(v)
+	case TypeCountry:
+		if !l.geoip.HasCountry() {
+			return Rule{}, ErrNoCountryDB
+		}
+	case TypeASN:
+		if !l.geoip.HasASN() {
+			return Rule{}, ErrNoASNDB
+		}
+		n, _ := strconv.ParseUint(v[2:], 10, 32)
+		r.asn = uint(n)
+	}
+	return r, nil
+}
+
+// parseValue detects the rule type and returns the value in canonical form:
+// IPs and CIDRs normalized, countries upper-case, ASNs as "AS<number>".
+func parseValue(value string) (string, string, error) {
+	value = strings.TrimSpace(value)
+	if addr, err := netip.ParseAddr(value); err == nil {
+		return TypeIP, addr.Unmap().WithZone("").String(), nil
+	}
+	if p, err := netip.ParsePrefix(value); err == nil {
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		return TypeCIDR, p.Masked().String(), nil
+	}
+	if len(value) > 2 && strings.EqualFold(value[:2], "AS") {
+		if n, err := strconv.ParseUint(value[2:], 10, 32); err == nil && n > 0 {
+			return TypeASN, "AS" + strconv.FormatUint(n, 10), nil
+		}
+	}
+	if len(value) == 2 && isLetters(value) {
+		return TypeCountry, strings.ToUpper(value), nil
+	}
+	return "", "", fmt.Errorf("%q is not an IP address, CIDR, country code or ASN", value)
+}
+
+func isLetters(s string) bool {
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return true
+}
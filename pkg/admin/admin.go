@@ -0,0 +1,210 @@
+// Package admin implements the authenticated admin API used to act on
+// incidents without a redeploy.
+package admin
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"altcha/pkg/access"
+	"altcha/pkg/apikey"
+	"altcha/pkg/config"
+	"altcha/pkg/handler"
+	"altcha/pkg/store"
+)
+
+type API struct {
+	config *config.Holder
+	store  store.Store
+	access *access.List
+}
+
+func New(h *config.Holder, s store.Store, l *access.List) *API {
+	return &API{config: h, store: s, access: l}
+}
+
+// Register adds the admin routes to e, authenticated with keys.
+func (a *API) Register(e *echo.Echo, keys *apikey.Keyring) {
+	g := e.Group("", Auth(keys))
+
+	g.GET("/config", a.getConfig)
+	g.PUT("/config/:key", a.setConfig)
+	g.DELETE("/config/:key", a.unsetConfig)
+
+	g.GET("/access", a.listRules)
+	g.POST("/access", a.addRule)
+	g.DELETE("/access", a.removeRule)
+
+	g.POST("/revoke", a.revoke)
+	g.POST("/store/flush", a.flushStore)
+	g.POST("/secret/rotate", a.rotateSecret)
+}
+
+// Auth requires an admin API key (X-API-Key or Authorization: Bearer).
+func Auth(keys *apikey.Keyring) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key, ok := keys.Lookup(apikey.KeyFromRequest(c.Request()))
+			if !ok {
+				return c.NoContent(http.StatusUnauthorized)
+			}
+			c.Set(apikey.ContextKey, key.ID)
+			if !key.Allow() {
+				return c.NoContent(http.StatusTooManyRequests)
+			}
+			return next(c)
+		}
+	}
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func badRequest(c echo.Context, err error) error {
+	detail(c, "%v", err)
+	return c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+}
+
+func (a *API) getConfig(c echo.Context) error {
+	cfg := a.config.Get()
+	res := map[string]any{
+		"config":    cfg.Values(),
+		"overrides": a.config.Overrides(),
+	}
+	if len(cfg.Secrets()) > 1 {
+		res["previous_secret_until"] = cfg.PreviousSecretUntil.UTC()
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+type valueRequest struct {
+	Value string `json:"value"`
+}
+
+func (a *API) setConfig(c echo.Context) error {
+	var req valueRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	changes, err := a.config.Set(c.Param("key"), req.Value)
+	if err != nil {
+		return badRequest(c, err)
+	}
+	auditChanges(c, changes)
+	return c.JSON(http.StatusOK, map[string]any{"changes": changes})
+}
+
+func (a *API) unsetConfig(c echo.Context) error {
+	changes, err := a.config.Unset(c.Param("key"))
+	if err != nil {
+		return badRequest(c, err)
+	}
+	auditChanges(c, changes)
+	return c.JSON(http.StatusOK, map[string]any{"changes": changes})
+}
+
+func auditChanges(c echo.Context, changes []config.Change) {
+	parts := make([]string, len(changes))
+	for i, ch := range changes {
+		parts[i] = ch.String()
+	}
+	detail(c, "%s", strings.Join(parts, "; "))
+}
+
+func (a *API) listRules(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]any{"rules": a.access.Rules()})
+}
+
+type ruleRequest struct {
+	Action string `json:"action"`
+	Value  string `json:"value"`
+}
+
+func (a *API) addRule(c echo.Context) error {
+	req := ruleRequest{Action: access.ActionBlock}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	rule, err := a.access.Add(req.Action, req.Value)
+	if err != nil {
+		return badRequest(c, err)
+	}
+	detail(c, "added rule %s (%s)", rule, rule.Type)
+	return c.JSON(http.StatusCreated, rule)
+}
+
+func (a *API) removeRule(c echo.Context) error {
+	value := c.QueryParam("value")
+	ok, err := a.access.Remove(value)
+	if err != nil {
+		return badRequest(c, err)
+	}
+	if !ok {
+		return c.NoContent(http.StatusNotFound)
+	}
+	detail(c, "removed rule for %s", value)
+	return c.NoContent(http.StatusNoContent)
+}
+
+type revokeRequest struct {
+	Payload string `json:"payload"`
+}
+
+// revoke marks a payload as used so it can no longer be verified.
+func (a *API) revoke(c echo.Context) error {
+	var req revokeRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	decoded, err := handler.DecodePayload(req.Payload)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse{Error: "payload is not a valid altcha payload"})
+	}
+	if err := a.store.Add(req.Payload); err != nil {
+		return err
+	}
+	detail(c, "revoked payload with salt %s", decoded.Salt)
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (a *API) flushStore(c echo.Context) error {
+	if err := a.store.Flush(); err != nil {
+		return err
+	}
+	detail(c, "flushed %s store", a.config.Get().Store)
+	return c.NoContent(http.StatusNoContent)
+}
+
+type rotateRequest struct {
+	// GraceMinutes keeps the previous secret valid; defaults to EXPIREMINUTES.
+	GraceMinutes *int `json:"grace_minutes"`
+}
+
+func (a *API) rotateSecret(c echo.Context) error {
+	var req rotateRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	grace := a.config.Get().ExpireMinutes
+	if req.GraceMinutes != nil {
+		grace = *req.GraceMinutes
+	}
+	if grace < 0 {
+		return c.JSON(http.StatusBadRequest, errorResponse{Error: "grace_minutes must not be negative"})
+	}
+
+	if err := a.config.RotateSecret(time.Duration(grace) * time.Minute); err != nil {
+		return err
+	}
+	until := a.config.Get().PreviousSecretUntil.UTC()
+	detail(c, "rotated secret, previous valid until %s", until.Format(time.RFC3339))
+	return c.JSON(http.StatusOK, map[string]any{
+		"previous_secret_until": until,
+		"note": "The new key exists only in this process: other replicas keep verifying with their own SECRET, " +
+			"a restart reverts to SECRET, and a reload that finds a changed SECRET or SECRET_FILE replaces it.",
+	})
+}
@@ -0,0 +1,99 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"altcha/pkg/apikey"
+)
+
+// detailKey is the echo context key handlers use to describe what they did.
+const detailKey = "admin_audit_detail"
+
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Key    string    `json:"key"`
+	IP     string    `json:"ip"`
+	Action string    `json:"action"`
+	Status int       `json:"status"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// Auditor writes one JSON line per admin request.
+type Auditor struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix string
+	closer io.Closer
+}
+
+// NewAuditor appends to path, or prints to stdout with an [AUDIT] prefix when
+// path is empty.
+func NewAuditor(path string) (*Auditor, error) {
+	if path == "" {
+		return &Auditor{w: os.Stdout, prefix: "[AUDIT] "}, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Auditor{w: f, closer: f}, nil
+}
+
+func (a *Auditor) Close() error {
+	if a.closer != nil {
+		return a.closer.Close()
+	}
+	return nil
+}
+
+func (a *Auditor) write(e auditEntry) {
+	var buf bytes.Buffer
+	buf.WriteString(a.prefix)
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(e); err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.w.Write(buf.Bytes())
+}
+
+// Middleware records every request, including rejected ones.
+func (a *Auditor) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+
+			e := auditEntry{
+				Time:   time.Now().UTC(),
+				IP:     c.RealIP(),
+				Action: c.Request().Method + " " + c.Request().URL.RequestURI(),
+				Status: c.Response().Status,
+			}
+			if id, ok := c.Get(apikey.ContextKey).(string); ok {
+				e.Key = id
+			}
+			if d, ok := c.Get(detailKey).(string); ok {
+				e.Detail = d
+			}
+			a.write(e)
+			return nil
+		}
+	}
+}
+
+func detail(c echo.Context, format string, args ...interface{}) {
+	c.Set(detailKey, fmt.Sprintf(format, args...))
+}
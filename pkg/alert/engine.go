@@ -0,0 +1,197 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"altcha/pkg/analytics"
+)
+
+// state tracks one rule between evaluations.
+type state struct {
+	// pending is when the condition started to hold, zero when it doesn't.
+	pending time.Time
+	firing  bool
+	since   time.Time // when the firing condition started to hold
+	sent    time.Time // last firing notification
+}
+
+// Engine evaluates the rules of a File at its interval. Notifications are
+// only sent on transitions (and with Repeat), so a rule that keeps firing
+// doesn't flood the notifiers.
+//
+// The rule states are kept in memory only. Engines don't coordinate, so
+// only one should run against a database, and a restart forgets firing
+// rules: a rule resolved while the engine is down is never notified as
+// resolved, and one still firing notifies again once For has passed.
+type Engine struct {
+	file      *File
+	src       analytics.Source
+	notifiers map[string]notifier
+	states    map[string]*state
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewEngine starts evaluating f over src.
+func NewEngine(f *File, src analytics.Source) *Engine {
+	e := newEngine(f, src)
+	e.wg.Add(1)
+	go e.loop()
+	return e
+}
+
+func newEngine(f *File, src analytics.Source) *Engine {
+	client := &http.Client{Timeout: notifyTimeout}
+	e := &Engine{
+		file:      f,
+		src:       src,
+		notifiers: make(map[string]notifier),
+		states:    make(map[string]*state),
+		done:      make(chan struct{}),
+	}
+	for _, n := range f.Notifiers {
+		e.notifiers[n.Name] = newNotifier(n, client)
+	}
+	for _, r := range f.Rules {
+		e.states[r.Name] = &state{}
+	}
+	return e
+}
+
+func (e *Engine) Close() {
+	close(e.done)
+	e.wg.Wait()
+}
+
+func (e *Engine) loop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(e.file.Interval))
+	defer ticker.Stop()
+
+	for {
+		e.run()
+		select {
+		case <-ticker.C:
+		case <-e.done:
+			return
+		}
+	}
+}
+
+func (e *Engine) run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-e.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	e.evaluate(ctx, time.Now())
+}
+
+// evaluate checks every rule at now. Rules sharing a window share the
+// summary query. A rule whose query fails keeps its state.
+func (e *Engine) evaluate(ctx context.Context, now time.Time) {
+	summaries := map[Duration]*analytics.Summary{}
+	for _, r := range e.file.Rules {
+		s, ok := summaries[r.Window]
+		if !ok {
+			var err error
+			s, err = e.src.Summary(ctx, now.Add(-time.Duration(r.Window)), now)
+			if err != nil {
+				if ctx.Err() == nil {
+					fmt.Printf("[ALERT]: Failed to evaluate %s: %v\n", r.Name, err)
+				}
+				continue
+			}
+			summaries[r.Window] = s
+		}
+		e.step(ctx, r, s, now)
+	}
+}
+
+// step advances the state of r with the summary of its window.
+func (e *Engine) step(ctx context.Context, r Rule, s *analytics.Summary, now time.Time) {
+	st := e.states[r.Name]
+	value, defined := Metrics[r.Metric](s, time.Duration(r.Window))
+	breach := defined && s.TotalRequests >= r.MinRequests && operators[r.Op](value, r.Threshold)
+
+	if !breach {
+		st.pending = time.Time{}
+		if st.firing {
+			st.firing = false
+			fmt.Printf("[ALERT]: %s resolved\n", r.Name)
+			e.send(ctx, r, newNotification(StatusResolved, r, value, st.since, now))
+		}
+		return
+	}
+
+	if st.pending.IsZero() {
+		st.pending = now
+	}
+	switch {
+	case !st.firing && now.Sub(st.pending) >= time.Duration(r.For):
+		st.firing = true
+		st.since, st.sent = st.pending, now
+		fmt.Printf("[ALERT]: %s firing: %s is %g\n", r.Name, r.Metric, value)
+		e.send(ctx, r, newNotification(StatusFiring, r, value, st.pending, now))
+	case st.firing && r.Repeat > 0 && now.Sub(st.sent) >= time.Duration(r.Repeat):
+		st.sent = now
+		e.send(ctx, r, newNotification(StatusFiring, r, value, st.pending, now))
+	}
+}
+
+// send delivers n to the notifiers of r. Failures are logged, not retried.
+func (e *Engine) send(ctx context.Context, r Rule, n Notification) {
+	names := r.Notify
+	if len(names) == 0 {
+		for _, cfg := range e.file.Notifiers {
+			names = append(names, cfg.Name)
+		}
+	}
+	for _, name := range names {
+		if err := e.deliver(ctx, name, n); err != nil && ctx.Err() == nil {
+			fmt.Printf("[ALERT]: Failed to notify %s of %s: %v\n", name, r.Name, err)
+		}
+	}
+}
+
+func (e *Engine) deliver(ctx context.Context, name string, n Notification) error {
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	return e.notifiers[name].notify(ctx, n)
+}
+
+// SendTest sends a test notification to the named notifiers of f, or to all
+// of them when names is empty, and returns the failures by notifier.
+func SendTest(ctx context.Context, f *File, names []string) error {
+	e := newEngine(f, nil)
+	if len(names) == 0 {
+		for _, cfg := range f.Notifiers {
+			names = append(names, cfg.Name)
+		}
+	}
+
+	now := time.Now()
+	r := Rule{Name: "test", Metric: "failure_rate", Op: ">", Threshold: 50, Window: Duration(defaultWindow)}
+	n := newNotification(StatusTest, r, 75, now, now)
+	var errs []error
+	for _, name := range names {
+		if _, ok := e.notifiers[name]; !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown notifier", name))
+			continue
+		}
+		if err := e.deliver(ctx, name, n); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,225 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"altcha/pkg/analytics"
+)
+
+// fakeSource answers Summary with summary; the other queries aren't used by
+// the engine.
+type fakeSource struct {
+	analytics.Source
+	summary analytics.Summary
+}
+
+func (s *fakeSource) Summary(ctx context.Context, from, to time.Time) (*analytics.Summary, error) {
+	summary := s.summary
+	return &summary, nil
+}
+
+// receiver records the JSON bodies POSTed to it.
+type receiver struct {
+	mu     sync.Mutex
+	bodies []map[string]any
+}
+
+func newReceiver(t *testing.T) (*receiver, string) {
+	t.Helper()
+	r := &receiver{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		var body map[string]any
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+		r.mu.Lock()
+		r.bodies = append(r.bodies, body)
+		r.mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	return r, srv.URL
+}
+
+func (r *receiver) take() []map[string]any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	bodies := r.bodies
+	r.bodies = nil
+	return bodies
+}
+
+// newTestEngine returns an engine for one rule on failed > 10 over 5m,
+// notifying a webhook and a Slack receiver.
+func newTestEngine(t *testing.T, rule Rule) (*Engine, *fakeSource, *receiver, *receiver) {
+	t.Helper()
+	hook, hookURL := newReceiver(t)
+	slack, slackURL := newReceiver(t)
+	rule.Name, rule.Metric, rule.Threshold = "failing", "failed", 10
+	f := &File{
+		Notifiers: []NotifierConfig{
+			{Name: "hook", Type: NotifierWebhook, URL: hookURL},
+			{Name: "chat", Type: NotifierSlack, URL: slackURL},
+		},
+		Rules: []Rule{rule},
+	}
+	if err := f.validate(); err != nil {
+		t.Fatal(err)
+	}
+	src := &fakeSource{}
+	return newEngine(f, src), src, hook, slack
+}
+
+func statuses(bodies []map[string]any) []string {
+	var s []string
+	for _, b := range bodies {
+		s = append(s, b["status"].(string))
+	}
+	return s
+}
+
+func TestEngineFiresAfterFor(t *testing.T) {
+	e, src, hook, _ := newTestEngine(t, Rule{For: Duration(2 * time.Minute)})
+	ctx := context.Background()
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	src.summary = analytics.Summary{TotalRequests: 100, Failed: 20}
+	for _, m := range []time.Duration{0, time.Minute} {
+		e.evaluate(ctx, start.Add(m))
+		if got := hook.take(); len(got) != 0 {
+			t.Fatalf("notified at +%s, before for: %v", m, got)
+		}
+	}
+	e.evaluate(ctx, start.Add(2*time.Minute))
+	got := hook.take()
+	if !slices.Equal(statuses(got), []string{StatusFiring}) {
+		t.Fatalf("statuses = %v, want [firing]", statuses(got))
+	}
+	if since := got[0]["since"]; since != start.Format(time.RFC3339) {
+		t.Errorf("since = %v, want %s", since, start.Format(time.RFC3339))
+	}
+}
+
+func TestEngineRestartsForAfterGap(t *testing.T) {
+	e, src, hook, _ := newTestEngine(t, Rule{For: Duration(2 * time.Minute)})
+	ctx := context.Background()
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	src.summary = analytics.Summary{TotalRequests: 100, Failed: 20}
+	e.evaluate(ctx, start)
+	src.summary = analytics.Summary{TotalRequests: 100}
+	e.evaluate(ctx, start.Add(time.Minute))
+	src.summary = analytics.Summary{TotalRequests: 100, Failed: 20}
+	e.evaluate(ctx, start.Add(2*time.Minute))
+	if got := hook.take(); len(got) != 0 {
+		t.Fatalf("notified although the condition didn't hold for 2m: %v", statuses(got))
+	}
+}
+
+func TestEngineDeduplicates(t *testing.T) {
+	e, src, hook, _ := newTestEngine(t, Rule{})
+	ctx := context.Background()
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	src.summary = analytics.Summary{TotalRequests: 100, Failed: 20}
+	for i := 0; i < 5; i++ {
+		e.evaluate(ctx, start.Add(time.Duration(i)*time.Minute))
+	}
+	if got := statuses(hook.take()); !slices.Equal(got, []string{StatusFiring}) {
+		t.Fatalf("statuses = %v, want a single firing", got)
+	}
+}
+
+func TestEngineRepeat(t *testing.T) {
+	e, src, hook, _ := newTestEngine(t, Rule{Repeat: Duration(10 * time.Minute)})
+	ctx := context.Background()
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	src.summary = analytics.Summary{TotalRequests: 100, Failed: 20}
+	var got []string
+	for m := 0; m <= 25; m += 5 {
+		e.evaluate(ctx, start.Add(time.Duration(m)*time.Minute))
+		got = append(got, statuses(hook.take())...)
+	}
+	// firing at 0, repeated at 10 and 20
+	want := []string{StatusFiring, StatusFiring, StatusFiring}
+	if !slices.Equal(got, want) {
+		t.Fatalf("statuses = %v, want %v", got, want)
+	}
+}
+
+func TestEngineResolves(t *testing.T) {
+	e, src, hook, _ := newTestEngine(t, Rule{})
+	ctx := context.Background()
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	src.summary = analytics.Summary{TotalRequests: 100, Failed: 20}
+	e.evaluate(ctx, start)
+	src.summary = analytics.Summary{TotalRequests: 100, Failed: 2}
+	e.evaluate(ctx, start.Add(3*time.Minute))
+	e.evaluate(ctx, start.Add(4*time.Minute))
+
+	got := hook.take()
+	if !slices.Equal(statuses(got), []string{StatusFiring, StatusResolved}) {
+		t.Fatalf("statuses = %v, want [firing resolved]", statuses(got))
+	}
+	resolved := got[1]
+	if resolved["value"] != 2.0 {
+		t.Errorf("value = %v, want 2", resolved["value"])
+	}
+	want := "[ALTCHA] RESOLVED failing: failed is 2 (threshold > 10 over 5m), fired for 3m"
+	if resolved["text"] != want {
+		t.Errorf("text = %q, want %q", resolved["text"], want)
+	}
+}
+
+func TestNotificationPayloads(t *testing.T) {
+	e, src, hook, slack := newTestEngine(t, Rule{})
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	src.summary = analytics.Summary{TotalRequests: 100, Failed: 20}
+	e.evaluate(context.Background(), start)
+
+	hooks := hook.take()
+	if len(hooks) != 1 {
+		t.Fatalf("webhook received %d notifications, want 1", len(hooks))
+	}
+	text := "[ALTCHA] FIRING failing: failed is 20 (threshold > 10 over 5m)"
+	want := map[string]any{
+		"status":    "firing",
+		"rule":      "failing",
+		"metric":    "failed",
+		"op":        ">",
+		"threshold": 10.0,
+		"value":     20.0,
+		"window":    "5m",
+		"since":     "2026-01-01T10:00:00Z",
+		"at":        "2026-01-01T10:00:00Z",
+		"text":      text,
+	}
+	if len(hooks[0]) != len(want) {
+		t.Errorf("webhook payload = %v, want %v", hooks[0], want)
+	}
+	for k, v := range want {
+		if hooks[0][k] != v {
+			t.Errorf("webhook %s = %v, want %v", k, hooks[0][k], v)
+		}
+	}
+
+	slacks := slack.take()
+	if len(slacks) != 1 {
+		t.Fatalf("slack received %d notifications, want 1", len(slacks))
+	}
+	if len(slacks[0]) != 1 || slacks[0]["text"] != text {
+		t.Errorf("slack payload = %v, want only text %q", slacks[0], text)
+	}
+}
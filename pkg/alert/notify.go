@@ -0,0 +1,205 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statuses of a Notification.
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+	StatusTest     = "test"
+)
+
+const notifyTimeout = 10 * time.Second
+
+// Notification is sent when a rule starts firing, while it keeps firing (with
+// Repeat) and when it resolves. Webhooks receive it as JSON.
+type Notification struct {
+	Status    string    `json:"status"`
+	Rule      string    `json:"rule"`
+	Metric    string    `json:"metric"`
+	Op        string    `json:"op"`
+	Threshold float64   `json:"threshold"`
+	Value     float64   `json:"value"`
+	Window    string    `json:"window"`
+	Since     time.Time `json:"since"`
+	At        time.Time `json:"at"`
+	// Text is a one-line description, also the Slack message and mail
+	// subject.
+	Text string `json:"text"`
+}
+
+func newNotification(status string, r Rule, value float64, since, at time.Time) Notification {
+	n := Notification{
+		Status:    status,
+		Rule:      r.Name,
+		Metric:    r.Metric,
+		Op:        r.Op,
+		Threshold: r.Threshold,
+		Value:     value,
+		Window:    r.Window.String(),
+		Since:     since.UTC(),
+		At:        at.UTC(),
+	}
+	n.Text = fmt.Sprintf("[ALTCHA] %s %s: %s is %s (threshold %s %g over %s)",
+		strings.ToUpper(status), r.Name, r.Metric, strconv.FormatFloat(math.Round(value*100)/100, 'f', -1, 64), r.Op, r.Threshold, r.Window)
+	if status == StatusResolved {
+		n.Text += fmt.Sprintf(", fired for %s", Duration(at.Sub(since).Round(time.Second)))
+	}
+	return n
+}
+
+type notifier interface {
+	notify(ctx context.Context, n Notification) error
+}
+
+func newNotifier(cfg NotifierConfig, client *http.Client) notifier {
+	switch cfg.Type {
+	case NotifierSlack:
+		return &webhook{cfg: cfg, client: client, body: func(n Notification) any {
+			return map[string]string{"text": n.Text}
+		}}
+	case NotifierSMTP:
+		return &mailer{cfg: cfg}
+	default:
+		return &webhook{cfg: cfg, client: client, body: func(n Notification) any { return n }}
+	}
+}
+
+// webhook POSTs JSON to a URL: the Notification, or {"text": ...} for Slack
+// and compatible chat services.
+type webhook struct {
+	cfg    NotifierConfig
+	client *http.Client
+	body   func(Notification) any
+}
+
+func (w *webhook) notify(ctx context.Context, n Notification) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(w.body(n)); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "altcha-alert")
+	for k, v := range w.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// mailer sends a plain-text mail, upgrading to TLS when the server offers
+// STARTTLS. The connection is bound to the deadline of the context, so a
+// stalled server can't hold the engine.
+type mailer struct {
+	cfg NotifierConfig
+}
+
+func (m *mailer) notify(ctx context.Context, n Notification) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(m.cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", n.Text)
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.At.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "Rule:      %s\r\n", n.Rule)
+	fmt.Fprintf(&msg, "Status:    %s\r\n", n.Status)
+	fmt.Fprintf(&msg, "Condition: %s %s %g over %s\r\n", n.Metric, n.Op, n.Threshold, n.Window)
+	fmt.Fprintf(&msg, "Value:     %g\r\n", n.Value)
+	fmt.Fprintf(&msg, "Since:     %s\r\n", n.Since.Format(time.RFC3339))
+	fmt.Fprintf(&msg, "At:        %s\r\n", n.At.Format(time.RFC3339))
+
+	dialer := net.Dialer{Timeout: notifyTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(m.cfg.Host, strconv.Itoa(m.cfg.Port)))
+	if err != nil {
+		return err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(notifyTimeout)
+	}
+	conn.SetDeadline(deadline)
+	// Unblocks the client when ctx is cancelled before its deadline.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := m.send(conn, msg.Bytes()); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// send runs the SMTP transaction of smtp.SendMail on conn.
+func (m *mailer) send(conn net.Conn, msg []byte) error {
+	c, err := smtp.NewClient(conn, m.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.cfg.Host}); err != nil {
+			return err
+		}
+	}
+	if m.cfg.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.cfg.From); err != nil {
+		return err
+	}
+	for _, to := range m.cfg.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
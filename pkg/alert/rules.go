@@ -0,0 +1,300 @@
+// Package alert evaluates threshold rules over the analytics data and
+// notifies webhooks, Slack and email when a rule starts or stops firing.
+package alert
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"altcha/pkg/analytics"
+)
+
+// Metrics are the values a rule can watch, computed from the summary of its
+// window.
+var Metrics = map[string]func(s *analytics.Summary, window time.Duration) (float64, bool){
+	"requests":   func(s *analytics.Summary, _ time.Duration) (float64, bool) { return float64(s.TotalRequests), true },
+	"challenges": func(s *analytics.Summary, _ time.Duration) (float64, bool) { return float64(s.Challenges), true },
+	// challenge_rate is challenges per minute.
+	"challenge_rate": func(s *analytics.Summary, w time.Duration) (float64, bool) {
+		return float64(s.Challenges) / w.Minutes(), true
+	},
+	"verified": func(s *analytics.Summary, _ time.Duration) (float64, bool) { return float64(s.Verified), true },
+	"failed":   func(s *analytics.Summary, _ time.Duration) (float64, bool) { return float64(s.Failed), true },
+	// failure_rate is failed as a percentage of verifications, undefined
+	// without any.
+	"failure_rate": func(s *analytics.Summary, _ time.Duration) (float64, bool) {
+		settled := s.Verified + s.Failed
+		if settled == 0 {
+			return 0, false
+		}
+		return float64(s.Failed) / float64(settled) * 100, true
+	},
+	"errors_4xx": func(s *analytics.Summary, _ time.Duration) (float64, bool) { return float64(s.Errors4XX), true },
+	"errors_5xx": func(s *analytics.Summary, _ time.Duration) (float64, bool) { return float64(s.Errors5XX), true },
+	"p95_latency_ms": func(s *analytics.Summary, _ time.Duration) (float64, bool) {
+		return s.P95LatencyMs, s.TotalRequests > 0
+	},
+}
+
+var operators = map[string]func(v, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+}
+
+const (
+	NotifierWebhook = "webhook"
+	NotifierSlack   = "slack"
+	NotifierSMTP    = "smtp"
+)
+
+const (
+	defaultInterval = time.Minute
+	minInterval     = 10 * time.Second
+	defaultWindow   = 5 * time.Minute
+)
+
+// File is a parsed rules file.
+type File struct {
+	// Interval is the time between evaluations.
+	Interval  Duration         `yaml:"interval"`
+	Notifiers []NotifierConfig `yaml:"notifiers"`
+	Rules     []Rule           `yaml:"rules"`
+}
+
+// NotifierConfig describes where notifications go. Webhook and Slack use URL
+// (and Headers); SMTP uses the remaining fields.
+type NotifierConfig struct {
+	Name    string            `yaml:"name"`
+	Type    string            `yaml:"type"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+
+	Host     string   `yaml:"host"`
+	Port     int      `yaml:"port"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// Rule fires when Metric compared with Threshold by Op holds over Window for
+// at least For.
+type Rule struct {
+	Name      string   `yaml:"name"`
+	Metric    string   `yaml:"metric"`
+	Op        string   `yaml:"op"`
+	Threshold float64  `yaml:"threshold"`
+	Window    Duration `yaml:"window"`
+	For       Duration `yaml:"for"`
+	// MinRequests skips windows with fewer requests, so a handful of
+	// failures at night doesn't page anyone.
+	MinRequests int64 `yaml:"min_requests"`
+	// Notify names the notifiers of the rule; all of them when empty.
+	Notify []string `yaml:"notify"`
+	// Repeat re-sends the firing notification at this interval while the
+	// rule keeps firing; 0 sends it once.
+	Repeat Duration `yaml:"repeat"`
+}
+
+// Duration is a time.Duration written as "5m" or "90s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	v, err := time.ParseDuration(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid duration %q", node.Line, node.Value)
+	}
+	if v < 0 {
+		return fmt.Errorf("line %d: negative duration %q", node.Line, node.Value)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// String drops zero minutes and seconds: 5m rather than 5m0s.
+func (d Duration) String() string {
+	s := time.Duration(d).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// envRef matches ${NAME} references, replaced by environment variables so
+// webhook URLs and passwords can stay out of the file. They are replaced in
+// the decoded notifier fields, never in the YAML, so a value can't change
+// the structure of the file.
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// LoadFile reads a YAML rules file:
+//
+//	interval: 1m
+//	notifiers:
+//	  - name: ops
+//	    type: slack
+//	    url: ${SLACK_WEBHOOK_URL}
+//	rules:
+//	  - name: failing-verifications
+//	    metric: failure_rate
+//	    threshold: 50
+//	    window: 5m
+//	    for: 5m
+func LoadFile(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f File
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	var missing []string
+	for i := range f.Notifiers {
+		missing = append(missing, f.Notifiers[i].expandEnv()...)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%s: environment variables not set: %v", path, missing)
+	}
+	if err := f.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &f, nil
+}
+
+func (f *File) validate() error {
+	if f.Interval == 0 {
+		f.Interval = Duration(defaultInterval)
+	}
+	if time.Duration(f.Interval) < minInterval {
+		return fmt.Errorf("interval: at least %s", minInterval)
+	}
+
+	var errs []error
+	names := map[string]bool{}
+	for i := range f.Notifiers {
+		n := &f.Notifiers[i]
+		if err := n.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("notifier #%d: %w", i+1, err))
+			continue
+		}
+		if names[n.Name] {
+			errs = append(errs, fmt.Errorf("notifier #%d: duplicate name %q", i+1, n.Name))
+		}
+		names[n.Name] = true
+	}
+	if len(f.Rules) == 0 {
+		errs = append(errs, errors.New("no rules defined"))
+	}
+
+	rules := map[string]bool{}
+	for i := range f.Rules {
+		r := &f.Rules[i]
+		if err := r.validate(names); err != nil {
+			errs = append(errs, fmt.Errorf("rule #%d: %w", i+1, err))
+			continue
+		}
+		if rules[r.Name] {
+			errs = append(errs, fmt.Errorf("rule #%d: duplicate name %q", i+1, r.Name))
+		}
+		rules[r.Name] = true
+	}
+	return errors.Join(errs...)
+}
+
+// expandEnv replaces the ${NAME} references in the URL, headers, address and
+// credential fields and returns the names of the unset variables.
+func (n *NotifierConfig) expandEnv() []string {
+	var missing []string
+	expand := func(s string) string {
+		return envRef.ReplaceAllStringFunc(s, func(ref string) string {
+			name := envRef.FindStringSubmatch(ref)[1]
+			v, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return v
+		})
+	}
+	n.URL = expand(n.URL)
+	for k, v := range n.Headers {
+		n.Headers[k] = expand(v)
+	}
+	n.Host = expand(n.Host)
+	n.Username = expand(n.Username)
+	n.Password = expand(n.Password)
+	n.From = expand(n.From)
+	for i, to := range n.To {
+		n.To[i] = expand(to)
+	}
+	return missing
+}
+
+func (n *NotifierConfig) validate() error {
+	if n.Name == "" {
+		return errors.New("missing name")
+	}
+	switch n.Type {
+	case NotifierWebhook, NotifierSlack:
+		u, err := url.Parse(n.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%q: url must be an http or https URL", n.Name)
+		}
+	case NotifierSMTP:
+		if n.Host == "" || n.From == "" || len(n.To) == 0 {
+			return fmt.Errorf("%q: smtp requires host, from and to", n.Name)
+		}
+		if n.Port == 0 {
+			n.Port = 587
+		}
+	default:
+		return fmt.Errorf("%q: type must be webhook, slack or smtp", n.Name)
+	}
+	return nil
+}
+
+func (r *Rule) validate(notifiers map[string]bool) error {
+	if r.Name == "" {
+		return errors.New("missing name")
+	}
+	if _, ok := Metrics[r.Metric]; !ok {
+		return fmt.Errorf("%q: unknown metric %q", r.Name, r.Metric)
+	}
+	if r.Op == "" {
+		r.Op = ">"
+	}
+	if _, ok := operators[r.Op]; !ok {
+		return fmt.Errorf("%q: op must be >, >=, < or <=", r.Name)
+	}
+	if r.Window == 0 {
+		r.Window = Duration(defaultWindow)
+	}
+	if time.Duration(r.Window) < time.Minute {
+		return fmt.Errorf("%q: window must be at least 1m", r.Name)
+	}
+	if len(notifiers) == 0 {
+		return fmt.Errorf("%q: no notifiers defined", r.Name)
+	}
+	for _, name := range r.Notify {
+		if !notifiers[name] {
+			return fmt.Errorf("%q: unknown notifier %q", r.Name, name)
+		}
+	}
+	return nil
+}
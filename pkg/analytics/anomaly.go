@@ -0,0 +1,234 @@
+package analytics
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"sort"
+	"time"
+)
+
+// AnomalyOptions configure QueryAnomalies.
+type AnomalyOptions struct {
+	// Window is the length of the current window and of each baseline window.
+	Window time.Duration
+	// Baseline is the number of windows before the current one the current
+	// window is compared with.
+	Baseline int
+	// Threshold is the z-score from which a count is a spike.
+	Threshold float64
+	// MinCount ignores counts below it, so rare keys don't flag on noise.
+	MinCount int64
+}
+
+// anomalyScopes are the groups checked for spikes: all events (no value) and
+// the groups of TopGroups that bot waves tend to share.
+var anomalyScopes = []struct {
+	name  string
+	group breakdownDimension
+}{
+	{"all", breakdownDimension{}},
+	{"country", TopGroups["country"]},
+	{"asn", TopGroups["asn"]},
+	{"subnet", TopGroups["subnet"]},
+}
+
+// anomalyMetrics are the counts checked for spikes, in the column order of
+// the anomaly query.
+var anomalyMetrics = []string{"challenges", "failed"}
+
+// Anomaly is a count of the current window well above its baseline.
+type Anomaly struct {
+	// Scope is all, country, asn or subnet; Key the country, ASN or subnet.
+	Scope string `json:"scope"`
+	Key   string `json:"key"`
+	Label string `json:"label,omitempty"`
+	// Metric is challenges or failed (failed verifications).
+	Metric  string  `json:"metric"`
+	Current int64   `json:"current"`
+	Mean    float64 `json:"mean"`
+	StdDev  float64 `json:"stddev"`
+	Z       float64 `json:"z"`
+}
+
+type AnomalyReport struct {
+	// From and To bound the current window; the baseline starts at
+	// BaselineFrom.
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+	BaselineFrom time.Time `json:"baseline_from"`
+	Anomalies    []Anomaly `json:"anomalies"`
+}
+
+// QueryAnomalies compares the window ending at end with the windows before
+// it and reports the counts whose z-score reaches the threshold, highest
+// first. The baseline only spans windows after the oldest raw event, as
+// windows purged by the retention would count as zero; without any such
+// window nothing is reported.
+func QueryAnomalies(ctx context.Context, db *sql.DB, end time.Time, opts AnomalyOptions) (*AnomalyReport, error) {
+	return queryAnomalies(ctx, db, postgres, end, opts)
+}
+
+func queryAnomalies(ctx context.Context, db *sql.DB, d dialect, end time.Time, opts AnomalyOptions) (*AnomalyReport, error) {
+	covered, err := coveredWindows(ctx, db, d, end, opts.Window)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Baseline > covered-1 {
+		opts.Baseline = max(covered-1, 0)
+	}
+	report := &AnomalyReport{
+		From:         end.Add(-opts.Window),
+		To:           end,
+		BaselineFrom: end.Add(-opts.Window * time.Duration(opts.Baseline+1)),
+		Anomalies:    []Anomaly{},
+	}
+	if opts.Baseline == 0 {
+		return report, nil
+	}
+	for _, scope := range anomalyScopes {
+		anomalies, err := scopeAnomalies(ctx, db, d, scope.name, scope.group, report, opts)
+		if err != nil {
+			return nil, err
+		}
+		report.Anomalies = append(report.Anomalies, anomalies...)
+	}
+	sort.SliceStable(report.Anomalies, func(i, j int) bool {
+		return report.Anomalies[i].Z > report.Anomalies[j].Z
+	})
+	return report, nil
+}
+
+// coveredWindows is the number of whole windows ending at end that start at
+// or after the oldest raw event.
+func coveredWindows(ctx context.Context, db *sql.DB, d dialect, end time.Time, window time.Duration) (int, error) {
+	var n sql.NullInt64
+	err := db.QueryRowContext(ctx, `
+		SELECT CAST(FLOOR(`+d.seconds("$1 - MIN(timestamp)")+` / $2) AS INTEGER)
+		FROM events
+		WHERE timestamp < $1
+	`, d.timestamp(end), window.Seconds()).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	return int(n.Int64), nil
+}
+
+// scopeAnomalies counts the events per key and window, where window 0 is the
+// current one, for the keys with at least MinCount events in the current
+// window.
+func scopeAnomalies(ctx context.Context, db *sql.DB, d dialect, scope string, group breakdownDimension, r *AnomalyReport, opts AnomalyOptions) ([]Anomaly, error) {
+	key, label, keys, groupBy := "''", "''", "", "slot"
+	if group.value != "" {
+		key, label, groupBy = group.value, group.label, group.value+", slot"
+		keys = `AND ` + group.value + ` IN (
+			SELECT ` + group.value + `
+			FROM events
+			WHERE timestamp >= $4 AND timestamp < $2
+			GROUP BY ` + group.value + `
+			HAVING COUNT(*) >= $5
+		)`
+	}
+	query := `
+		SELECT
+			` + key + `,
+			` + label + `,
+			CAST(FLOOR(` + d.seconds("$2 - timestamp") + ` / $3) AS INTEGER) AS slot,
+			COUNT(*) FILTER (WHERE endpoint = 'challenge'),
+			COUNT(*) FILTER (WHERE ` + failedCond + `)
+		FROM events
+		WHERE timestamp >= $1 AND timestamp < $2
+			` + keys + `
+		GROUP BY ` + groupBy + `
+	`
+	args := []interface{}{d.timestamp(r.BaselineFrom), d.timestamp(r.To), opts.Window.Seconds()}
+	if group.value != "" {
+		args = append(args, d.timestamp(r.From), opts.MinCount)
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type series struct {
+		label  string
+		counts [][]int64 // metric, window
+	}
+	byKey := map[string]*series{}
+	var order []string
+	for rows.Next() {
+		var key, label string
+		var slot int
+		counts := make([]int64, len(anomalyMetrics))
+		if err := rows.Scan(&key, &label, &slot, &counts[0], &counts[1]); err != nil {
+			return nil, err
+		}
+		if slot < 0 || slot > opts.Baseline {
+			continue
+		}
+		s, ok := byKey[key]
+		if !ok {
+			s = &series{counts: make([][]int64, len(anomalyMetrics))}
+			for i := range s.counts {
+				s.counts[i] = make([]int64, opts.Baseline+1)
+			}
+			byKey[key] = s
+			order = append(order, key)
+		}
+		if label != "" {
+			s.label = label
+		}
+		for i, n := range counts {
+			s.counts[i][slot] += n
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var anomalies []Anomaly
+	for _, key := range order {
+		s := byKey[key]
+		if scope == "asn" {
+			key = "AS" + key
+		}
+		for i, metric := range anomalyMetrics {
+			current := s.counts[i][0]
+			if current < opts.MinCount {
+				continue
+			}
+			mean, sd := meanStdDev(s.counts[i][1:])
+			z := (float64(current) - mean) / spread(mean, sd)
+			if z < opts.Threshold {
+				continue
+			}
+			anomalies = append(anomalies, Anomaly{Scope: scope, Key: key, Label: s.label,
+				Metric: metric, Current: current, Mean: mean, StdDev: sd, Z: z})
+		}
+	}
+	return anomalies, nil
+}
+
+func meanStdDev(counts []int64) (float64, float64) {
+	if len(counts) == 0 {
+		return 0, 0
+	}
+	var sum float64
+	for _, n := range counts {
+		sum += float64(n)
+	}
+	mean := sum / float64(len(counts))
+	var sq float64
+	for _, n := range counts {
+		sq += (float64(n) - mean) * (float64(n) - mean)
+	}
+	return mean, math.Sqrt(sq / float64(len(counts)))
+}
+
+// spread is the standard deviation the z-score divides by. Counts are
+// roughly Poisson distributed, so a flat or empty baseline still allows
+// sqrt(mean) of noise, and at least 1.
+func spread(mean, sd float64) float64 {
+	return math.Max(sd, math.Max(math.Sqrt(mean), 1))
+}
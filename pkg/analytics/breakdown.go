@@ -0,0 +1,121 @@
+package analytics
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// breakdownDimension is the SQL of a dimension events can be broken down by.
+type breakdownDimension struct {
+	// value is grouped by; NULL becomes "".
+	value string
+	// label is an aggregate describing the value, or ''.
+	label string
+	// where restricts the events to those the dimension applies to.
+	where string
+}
+
+// Dimensions lists the dimensions accepted by QueryBreakdown.
+var Dimensions = map[string]breakdownDimension{
+	"reason":     {value: "reason", label: "''", where: "endpoint IN ('verify', 'forward-auth')"},
+	"algorithm":  {value: "algorithm", label: "''"},
+	"complexity": {value: "CAST(complexity AS TEXT)", label: "''", where: "endpoint = 'challenge'"},
+	"origin":     {value: "origin", label: "''"},
+	"ua":         {value: "ua_family", label: "''"},
+	"asn":        {value: "CAST(asn AS TEXT)", label: "COALESCE(MAX(as_org), '')"},
+	"city":       {value: "city", label: "COALESCE(MAX(country), '')"},
+}
+
+// MaxBreakdownRows caps the rows of a breakdown.
+const MaxBreakdownRows = 100
+
+// Verification outcomes of /verify and /forward-auth, as the funnel counts
+// them.
+const (
+	verifiedCond = `(endpoint = 'verify' AND status = 202) OR (endpoint = 'forward-auth' AND status = 200)`
+	failedCond   = `(endpoint = 'verify' AND status = 417) OR (endpoint = 'forward-auth' AND status IN (401, 403))`
+)
+
+// outcomeCounts selects the counts of BreakdownEntry after Value and Label.
+const outcomeCounts = `
+	COUNT(*) AS requests,
+	COUNT(*) FILTER (WHERE endpoint = 'challenge') AS challenges,
+	COUNT(*) FILTER (WHERE ` + verifiedCond + `) AS verified,
+	COUNT(*) FILTER (WHERE ` + failedCond + `) AS failed
+`
+
+// BreakdownEntry counts the events with one value of a dimension. Verified
+// and Failed count /verify and /forward-auth outcomes like the funnel does.
+type BreakdownEntry struct {
+	// Value is "" for events without one, e.g. recorded before the dimension
+	// existed or without the GeoIP database it comes from.
+	Value string `json:"value"`
+	// Label is the AS organization of an ASN, the country of a city, IP or
+	// subnet and the continent of a country.
+	Label      string `json:"label,omitempty"`
+	Requests   int64  `json:"requests"`
+	Challenges int64  `json:"challenges"`
+	Verified   int64  `json:"verified"`
+	Failed     int64  `json:"failed"`
+	// FailureRate is Failed as a percentage of Verified plus Failed.
+	FailureRate float64 `json:"failure_rate"`
+}
+
+// QueryBreakdown returns the limit values of dimension with the most requests
+// in [from, to). It reads raw events: the rollups have no dimensions.
+func QueryBreakdown(ctx context.Context, db *sql.DB, dimension string, from, to time.Time, limit int) ([]BreakdownEntry, error) {
+	return queryBreakdown(ctx, db, dimension, from, to, limit)
+}
+
+// queryBreakdown takes the bounds in the representation of the
+// events.timestamp column.
+func queryBreakdown(ctx context.Context, db *sql.DB, dimension string, from, to interface{}, limit int) ([]BreakdownEntry, error) {
+	dim, ok := Dimensions[dimension]
+	if !ok {
+		return nil, fmt.Errorf("unknown dimension %q", dimension)
+	}
+	if limit <= 0 || limit > MaxBreakdownRows {
+		limit = MaxBreakdownRows
+	}
+
+	where := "timestamp >= $1 AND timestamp < $2"
+	if dim.where != "" {
+		where += " AND " + dim.where
+	}
+	query := `
+		SELECT
+			COALESCE(` + dim.value + `, '') AS value,
+			` + dim.label + `,
+			` + outcomeCounts + `
+		FROM events
+		WHERE ` + where + `
+		GROUP BY COALESCE(` + dim.value + `, '')
+		ORDER BY requests DESC, value
+		LIMIT $3
+	`
+	rows, err := db.QueryContext(ctx, query, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanBreakdown(rows)
+}
+
+// scanBreakdown reads rows of value, label and outcomeCounts.
+func scanBreakdown(rows *sql.Rows) ([]BreakdownEntry, error) {
+	defer rows.Close()
+
+	entries := []BreakdownEntry{}
+	for rows.Next() {
+		var e BreakdownEntry
+		if err := rows.Scan(&e.Value, &e.Label, &e.Requests, &e.Challenges, &e.Verified, &e.Failed); err != nil {
+			return nil, err
+		}
+		if settled := e.Verified + e.Failed; settled > 0 {
+			e.FailureRate = float64(e.Failed) / float64(settled) * 100
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
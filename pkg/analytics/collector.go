@@ -0,0 +1,192 @@
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type Event struct {
+	Timestamp time.Time `json:"timestamp"`
+	Endpoint  string    `json:"endpoint"`
+	ClientIP  string    `json:"client_ip"`
+	Status    int       `json:"status"`
+	LatencyMs float64   `json:"latency_ms"`
+	Country   *string   `json:"country,omitempty"`
+	Continent *string   `json:"continent,omitempty"`
+	APIKey    *string   `json:"api_key,omitempty"`
+
+	// Subnet is the /24 or /48 network of the stored ClientIP, so it is unset
+	// when the IP mode hashes or drops addresses.
+	Subnet *string `json:"subnet,omitempty"`
+
+	// Set when an access rule matched the client (see pkg/access).
+	AccessAction *string `json:"access_action,omitempty"`
+	AccessRule   *string `json:"access_rule,omitempty"`
+
+	// ChallengeID links a /challenge event to the verification redeeming it
+	// (see handler.ChallengeID). Form is the ?form= label of /challenge.
+	ChallengeID *string `json:"challenge_id,omitempty"`
+	Form        *string `json:"form,omitempty"`
+
+	// Reason is the outcome of a verification (handler.Reason*). Algorithm
+	// is the one of the challenge issued or verified; Complexity is the
+	// maxnumber of an issued challenge.
+	Reason     *string `json:"reason,omitempty"`
+	Algorithm  *string `json:"algorithm,omitempty"`
+	Complexity *int64  `json:"complexity,omitempty"`
+
+	// Origin is the scheme and host of the Origin header, or of the Referer
+	// when there is none. UAFamily is the client family of the User-Agent
+	// (see UAFamily).
+	Origin   *string `json:"origin,omitempty"`
+	UAFamily *string `json:"ua_family,omitempty"`
+
+	// Set from the GeoIP ASN and city databases, like Country.
+	ASN   *int64  `json:"asn,omitempty"`
+	ASOrg *string `json:"as_org,omitempty"`
+	City  *string `json:"city,omitempty"`
+}
+
+// eventColumns are the events columns written by the SQL sinks, in the order
+// of Event.values.
+var eventColumns = []string{
+	"timestamp", "endpoint", "client_ip", "status", "latency_ms",
+	"country", "continent", "api_key", "access_action", "access_rule",
+	"challenge_id", "form", "reason", "algorithm", "complexity",
+	"origin", "ua_family", "asn", "as_org", "city", "subnet",
+}
+
+func (e Event) values() []interface{} {
+	return []interface{}{
+		e.Timestamp, e.Endpoint, e.ClientIP, e.Status, e.LatencyMs,
+		e.Country, e.Continent, e.APIKey, e.AccessAction, e.AccessRule,
+		e.ChallengeID, e.Form, e.Reason, e.Algorithm, e.Complexity,
+		e.Origin, e.UAFamily, e.ASN, e.ASOrg, e.City, e.Subnet,
+	}
+}
+
+// Collector batches recorded events in the background and writes them to its
+// sink, so requests never wait for analytics.
+type Collector struct {
+	sink   Sink
+	geoip  *GeoIP
+	ip     func() IPPolicy
+	events chan Event
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewCollector writes events to sink, which it closes on Close. geoip may be
+// nil; it is owned by the caller. ip is called for every event, so a reloaded
+// policy applies at once; nil stores addresses in full.
+func NewCollector(sink Sink, geoip *GeoIP, ip func() IPPolicy) *Collector {
+	c := &Collector{
+		sink:   sink,
+		geoip:  geoip,
+		ip:     ip,
+		events: make(chan Event, 4096),
+		done:   make(chan struct{}),
+	}
+	c.wg.Add(1)
+	go c.worker()
+	return c
+}
+
+func (c *Collector) Record(e Event) {
+	if c.geoip != nil {
+		e.Country, e.Continent = c.geoip.Lookup(e.ClientIP)
+		if asn, org := c.geoip.ASN(e.ClientIP); asn != 0 {
+			n := int64(asn)
+			e.ASN = &n
+			if org != "" {
+				e.ASOrg = &org
+			}
+		}
+		if city := c.geoip.City(e.ClientIP); city != "" {
+			e.City = &city
+		}
+	}
+	if c.ip != nil {
+		e.ClientIP = c.ip().Apply(e.ClientIP, e.Timestamp)
+	}
+	if subnet := subnetOf(e.ClientIP); subnet != "" {
+		e.Subnet = &subnet
+	}
+	select {
+	case c.events <- e:
+	default:
+		// channel full, drop event
+	}
+}
+
+// Ping checks that the sink can take events.
+func (c *Collector) Ping(ctx context.Context) error {
+	return c.sink.Ping(ctx)
+}
+
+func (c *Collector) Close() {
+	close(c.done)
+	c.wg.Wait()
+	if err := c.sink.Close(); err != nil {
+		fmt.Printf("[ANALYTICS]: Failed to close sink: %v\n", err)
+	}
+}
+
+func (c *Collector) worker() {
+	defer c.wg.Done()
+
+	batch := make([]Event, 0, 100)
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-c.events:
+			if !ok {
+				// channel closed
+				if len(batch) > 0 {
+					c.flush(batch)
+				}
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= 100 {
+				c.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				c.flush(batch)
+				batch = batch[:0]
+			}
+		case <-c.done:
+			// drain remaining events
+			for {
+				select {
+				case e := <-c.events:
+					batch = append(batch, e)
+				default:
+					if len(batch) > 0 {
+						c.flush(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *Collector) flush(batch []Event) {
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.sink.Write(ctx, batch); err != nil {
+		fmt.Printf("[ANALYTICS]: Failed to write batch: %v\n", err)
+	}
+}
@@ -0,0 +1,202 @@
+package analytics
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// funnelCTE links the challenges issued in [$1, $2) to their first
+// redemption on /verify or /forward-auth through challenge_id. A redemption
+// succeeded when /verify answered 202 or /forward-auth 200. It runs on
+// PostgreSQL and on SQLite, where timestamps are Unix milliseconds.
+const funnelCTE = `
+	WITH issued AS (
+		SELECT challenge_id, MIN(timestamp) AS issued_at, MAX(form) AS form
+		FROM events
+		WHERE endpoint = 'challenge' AND challenge_id IS NOT NULL
+			AND timestamp >= $1 AND timestamp < $2
+		GROUP BY challenge_id
+	), redeemed AS (
+		SELECT e.challenge_id,
+			MIN(e.timestamp) AS redeemed_at,
+			MIN(e.timestamp) FILTER (WHERE (e.endpoint = 'verify' AND e.status = 202)
+				OR (e.endpoint = 'forward-auth' AND e.status = 200)) AS verified_at
+		FROM events e
+		JOIN issued i ON i.challenge_id = e.challenge_id
+		WHERE e.endpoint IN ('verify', 'forward-auth') AND e.timestamp >= i.issued_at
+		GROUP BY e.challenge_id
+	)
+`
+
+type Funnel struct {
+	// Form is the ?form= label of /challenge, empty for unlabelled challenges.
+	Form     string `json:"form"`
+	Issued   int64  `json:"issued"`
+	Redeemed int64  `json:"redeemed"`
+	Verified int64  `json:"verified"`
+	// Pending challenges were not redeemed yet but may still be, since they
+	// were issued less than EXPIREMINUTES ago.
+	Pending   int64 `json:"pending"`
+	Abandoned int64 `json:"abandoned"`
+	// AbandonRate is Abandoned as a percentage of the settled (non-pending)
+	// challenges; Conversion is Verified as a percentage of Issued.
+	AbandonRate float64 `json:"abandon_rate"`
+	Conversion  float64 `json:"conversion"`
+}
+
+type FunnelReport struct {
+	Total Funnel   `json:"total"`
+	Forms []Funnel `json:"forms"`
+}
+
+func (f *Funnel) rates() {
+	f.Abandoned = f.Issued - f.Redeemed - f.Pending
+	if settled := f.Issued - f.Pending; settled > 0 {
+		f.AbandonRate = float64(f.Abandoned) / float64(settled) * 100
+	}
+	if f.Issued > 0 {
+		f.Conversion = float64(f.Verified) / float64(f.Issued) * 100
+	}
+}
+
+// QueryFunnel counts issued, redeemed and verified challenges per form.
+// Unredeemed challenges issued at or after pendingSince count as pending
+// instead of abandoned.
+func QueryFunnel(ctx context.Context, db *sql.DB, from, to, pendingSince time.Time) (*FunnelReport, error) {
+	return queryFunnel(ctx, db, from, to, pendingSince)
+}
+
+// queryFunnel takes the bounds in the representation of the events.timestamp
+// column.
+func queryFunnel(ctx context.Context, db *sql.DB, from, to, pendingSince interface{}) (*FunnelReport, error) {
+	query := funnelCTE + `
+		SELECT
+			COALESCE(i.form, '') AS form,
+			COUNT(*) AS issued,
+			COUNT(r.challenge_id) AS redeemed,
+			COUNT(r.verified_at) AS verified,
+			COUNT(*) FILTER (WHERE r.challenge_id IS NULL AND i.issued_at >= $3) AS pending
+		FROM issued i
+		LEFT JOIN redeemed r ON r.challenge_id = i.challenge_id
+		GROUP BY COALESCE(i.form, '')
+		ORDER BY issued DESC
+	`
+	rows, err := db.QueryContext(ctx, query, from, to, pendingSince)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &FunnelReport{Forms: []Funnel{}}
+	for rows.Next() {
+		var f Funnel
+		if err := rows.Scan(&f.Form, &f.Issued, &f.Redeemed, &f.Verified, &f.Pending); err != nil {
+			return nil, err
+		}
+		f.rates()
+		report.Forms = append(report.Forms, f)
+
+		report.Total.Issued += f.Issued
+		report.Total.Redeemed += f.Redeemed
+		report.Total.Verified += f.Verified
+		report.Total.Pending += f.Pending
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	report.Total.rates()
+	return report, nil
+}
+
+// solveTimeBounds are the lower bounds in seconds of the solve-time buckets
+// after the first one.
+var solveTimeBounds = []float64{1, 2, 5, 10, 30, 60, 300}
+
+var solveTimeLabels = []string{"<1s", "1-2s", "2-5s", "5-10s", "10-30s", "30-60s", "1-5m", ">5m"}
+
+// solveTimeBucket maps secs to the index of its solveTimeLabels entry, like
+// width_bucket but also on SQLite.
+var solveTimeBucket = func() string {
+	var b strings.Builder
+	b.WriteString("CASE")
+	for i, bound := range solveTimeBounds {
+		fmt.Fprintf(&b, " WHEN secs < %g THEN %d", bound, i)
+	}
+	fmt.Fprintf(&b, " ELSE %d END", len(solveTimeBounds))
+	return b.String()
+}()
+
+type SolveTimeBucket struct {
+	Label string `json:"label"`
+	Count int64  `json:"count"`
+}
+
+// SolveTimes is the distribution of the time between issuing a challenge and
+// its first successful verification, in seconds. It includes the time the user
+// spent filling in the form.
+type SolveTimes struct {
+	Count   int64             `json:"count"`
+	P50     float64           `json:"p50"`
+	P90     float64           `json:"p90"`
+	P99     float64           `json:"p99"`
+	Buckets []SolveTimeBucket `json:"buckets"`
+}
+
+func QuerySolveTimes(ctx context.Context, db *sql.DB, from, to time.Time) (*SolveTimes, error) {
+	return querySolveTimes(ctx, db, postgres, from, to)
+}
+
+func querySolveTimes(ctx context.Context, db *sql.DB, d dialect, from, to interface{}) (*SolveTimes, error) {
+	cte := funnelCTE + `, solved AS (
+		SELECT ` + d.seconds("r.verified_at - i.issued_at") + ` AS secs
+		FROM issued i
+		JOIN redeemed r ON r.challenge_id = i.challenge_id
+		WHERE r.verified_at IS NOT NULL
+	)`
+
+	st := &SolveTimes{}
+	err := db.QueryRowContext(ctx, cte+`
+		SELECT
+			COUNT(*),
+			COALESCE(`+d.percentile(0.5, "secs")+`, 0),
+			COALESCE(`+d.percentile(0.9, "secs")+`, 0),
+			COALESCE(`+d.percentile(0.99, "secs")+`, 0)
+		FROM solved
+	`, from, to).Scan(&st.Count, &st.P50, &st.P90, &st.P99)
+	if err != nil {
+		return nil, err
+	}
+
+	st.Buckets = make([]SolveTimeBucket, len(solveTimeLabels))
+	for i, label := range solveTimeLabels {
+		st.Buckets[i].Label = label
+	}
+	if st.Count == 0 {
+		return st, nil
+	}
+
+	rows, err := db.QueryContext(ctx, cte+`
+		SELECT `+solveTimeBucket+` AS bucket, COUNT(*)
+		FROM solved
+		GROUP BY bucket
+	`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bucket int
+		var count int64
+		if err := rows.Scan(&bucket, &count); err != nil {
+			return nil, err
+		}
+		if bucket >= 0 && bucket < len(st.Buckets) {
+			st.Buckets[bucket].Count = count
+		}
+	}
+	return st, rows.Err()
+}
@@ -1,13 +1,17 @@
 package analytics
 
 import (
+	"fmt"
 	"net"
 
 	"github.com/oschwald/maxminddb-golang"
 )
 
+// GeoIP reads MaxMind country, ASN and city databases, each optional.
 type GeoIP struct {
-	db *maxminddb.Reader
+	db   *maxminddb.Reader
+	asn  *maxminddb.Reader
+	city *maxminddb.Reader
 }
 
 type geoRecord struct {
@@ -19,22 +23,75 @@ type geoRecord struct {
 	} `maxminddb:"continent"`
 }
 
-func NewGeoIP(path string) (*GeoIP, error) {
-	db, err := maxminddb.Open(path)
-	if err != nil {
-		return nil, err
+type cityRecord struct {
+	City struct {
+		Names struct {
+			EN string `maxminddb:"en"`
+		} `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// NewGeoIP opens the country database at countryPath, the ASN database at
+// asnPath (GeoLite2-ASN) and the city database at cityPath (GeoLite2-City).
+// Any path may be empty; the city database also provides countries when
+// countryPath is.
+func NewGeoIP(countryPath, asnPath, cityPath string) (*GeoIP, error) {
+	g := &GeoIP{}
+	if countryPath != "" {
+		db, err := maxminddb.Open(countryPath)
+		if err != nil {
+			return nil, err
+		}
+		g.db = db
+	}
+	if asnPath != "" {
+		db, err := maxminddb.Open(asnPath)
+		if err != nil {
+			g.Close()
+			return nil, err
+		}
+		g.asn = db
+	}
+	if cityPath != "" {
+		db, err := maxminddb.Open(cityPath)
+		if err != nil {
+			g.Close()
+			return nil, err
+		}
+		g.city = db
+	}
+	return g, nil
+}
+
+func (g *GeoIP) HasCountry() bool { return g != nil && (g.db != nil || g.city != nil) }
+func (g *GeoIP) HasASN() bool     { return g != nil && g.asn != nil }
+func (g *GeoIP) HasCity() bool    { return g != nil && g.city != nil }
+
+// countryDB is the database countries are looked up in. City databases
+// contain the country records too.
+func (g *GeoIP) countryDB() *maxminddb.Reader {
+	if g.db != nil {
+		return g.db
 	}
-	return &GeoIP{db: db}, nil
+	return g.city
 }
 
 func (g *GeoIP) Lookup(ipStr string) (country *string, continent *string) {
+	if !g.HasCountry() {
+		return nil, nil
+	}
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
 		return nil, nil
 	}
 
 	var rec geoRecord
-	if err := g.db.Lookup(ip, &rec); err != nil {
+	if err := g.countryDB().Lookup(ip, &rec); err != nil {
 		return nil, nil
 	}
 
@@ -47,6 +104,75 @@ func (g *GeoIP) Lookup(ipStr string) (country *string, continent *string) {
 	return
 }
 
+// ASN returns the autonomous system number and organization of ip, or 0 when
+// unknown or no ASN database is loaded.
+func (g *GeoIP) ASN(ipStr string) (uint, string) {
+	if !g.HasASN() {
+		return 0, ""
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return 0, ""
+	}
+
+	var rec asnRecord
+	if err := g.asn.Lookup(ip, &rec); err != nil {
+		return 0, ""
+	}
+	return rec.Number, rec.Organization
+}
+
+// City returns the English name of the city of ip, or "" when unknown or no
+// city database is loaded.
+func (g *GeoIP) City(ipStr string) string {
+	if !g.HasCity() {
+		return ""
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return ""
+	}
+
+	var rec cityRecord
+	if err := g.city.Lookup(ip, &rec); err != nil {
+		return ""
+	}
+	return rec.City.Names.EN
+}
+
+// Check looks up a well-known public address in each loaded database and
+// returns the first read error.
+func (g *GeoIP) Check() error {
+	ip := net.ParseIP("8.8.8.8")
+	if g.db != nil {
+		var rec geoRecord
+		if err := g.db.Lookup(ip, &rec); err != nil {
+			return fmt.Errorf("country database: %w", err)
+		}
+	}
+	if g.HasASN() {
+		var rec asnRecord
+		if err := g.asn.Lookup(ip, &rec); err != nil {
+			return fmt.Errorf("ASN database: %w", err)
+		}
+	}
+	if g.HasCity() {
+		var rec cityRecord
+		if err := g.city.Lookup(ip, &rec); err != nil {
+			return fmt.Errorf("city database: %w", err)
+		}
+	}
+	return nil
+}
+
 func (g *GeoIP) Close() {
-	g.db.Close()
+	if g.db != nil {
+		g.db.Close()
+	}
+	if g.asn != nil {
+		g.asn.Close()
+	}
+	if g.city != nil {
+		g.city.Close()
+	}
 }
@@ -0,0 +1,350 @@
+package analytics
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// LiveChannel is the PostgreSQL notification channel of the live sink.
+const LiveChannel = "altcha_live"
+
+// maxLiveLocations caps the locations of a LiveBucket, keeping notifications
+// well below the 8000 byte payload limit of NOTIFY.
+const maxLiveLocations = 50
+
+// LiveBucket counts the events of one second for the live view. Replicas
+// publish their own buckets, so a second can arrive more than once; the
+// counts add up.
+type LiveBucket struct {
+	// Time is the second in Unix time.
+	Time       int64          `json:"t"`
+	Requests   int64          `json:"requests"`
+	Challenges int64          `json:"challenges"`
+	Verified   int64          `json:"verified"`
+	Failed     int64          `json:"failed"`
+	Errors     int64          `json:"errors"` // 5xx
+	Locations  []LiveLocation `json:"locations,omitempty"`
+}
+
+// LiveLocation counts the events of a bucket from one country. Events
+// without a country are left out.
+type LiveLocation struct {
+	Continent string `json:"continent"`
+	Country   string `json:"country"`
+	Count     int64  `json:"count"`
+}
+
+// liveBuckets groups batch by second, in time order. Verified and Failed
+// count like verifiedCond and failedCond.
+func liveBuckets(batch []Event) []LiveBucket {
+	type bucket struct {
+		LiveBucket
+		locations map[[2]string]int64
+	}
+	byTime := map[int64]*bucket{}
+	for _, e := range batch {
+		t := e.Timestamp.Unix()
+		b, ok := byTime[t]
+		if !ok {
+			b = &bucket{LiveBucket: LiveBucket{Time: t}, locations: map[[2]string]int64{}}
+			byTime[t] = b
+		}
+		b.Requests++
+		switch {
+		case e.Endpoint == "challenge":
+			b.Challenges++
+		case e.Endpoint == "verify" && e.Status == 202, e.Endpoint == "forward-auth" && e.Status == 200:
+			b.Verified++
+		case e.Endpoint == "verify" && e.Status == 417, e.Endpoint == "forward-auth" && (e.Status == 401 || e.Status == 403):
+			b.Failed++
+		}
+		if e.Status >= 500 {
+			b.Errors++
+		}
+		if e.Country != nil && *e.Country != "" {
+			continent := ""
+			if e.Continent != nil {
+				continent = *e.Continent
+			}
+			b.locations[[2]string{continent, *e.Country}]++
+		}
+	}
+
+	buckets := make([]LiveBucket, 0, len(byTime))
+	for _, b := range byTime {
+		for k, n := range b.locations {
+			b.Locations = append(b.Locations, LiveLocation{Continent: k[0], Country: k[1], Count: n})
+		}
+		sort.Slice(b.Locations, func(i, j int) bool {
+			if b.Locations[i].Count != b.Locations[j].Count {
+				return b.Locations[i].Count > b.Locations[j].Count
+			}
+			return b.Locations[i].Country < b.Locations[j].Country
+		})
+		if len(b.Locations) > maxLiveLocations {
+			b.Locations = b.Locations[:maxLiveLocations]
+		}
+		buckets = append(buckets, b.LiveBucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Time < buckets[j].Time })
+	return buckets
+}
+
+// LiveSink publishes every batch as LiveBuckets on LiveChannel with
+// pg_notify, for dashboards listening with ListenLive. Nothing is stored.
+type LiveSink struct {
+	db *sql.DB
+}
+
+func NewLiveSink(dsn func() string) (*LiveSink, error) {
+	db := OpenDB(dsn)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping postgres: %w", err)
+	}
+	return &LiveSink{db: db}, nil
+}
+
+func (s *LiveSink) Write(ctx context.Context, batch []Event) error {
+	for _, b := range liveBuckets(batch) {
+		payload, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		if _, err := s.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, LiveChannel, string(payload)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *LiveSink) Ping(ctx context.Context) error { return s.db.PingContext(ctx) }
+func (s *LiveSink) Close() error                   { return s.db.Close() }
+
+// LiveFeed hands LiveBuckets to the dashboard's live view subscribers.
+type LiveFeed struct {
+	mu   sync.Mutex
+	subs map[chan LiveBucket]struct{}
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newLiveFeed() *LiveFeed {
+	return &LiveFeed{subs: make(map[chan LiveBucket]struct{}), done: make(chan struct{})}
+}
+
+// Subscribe returns a channel receiving the buckets published from now on,
+// and a function to unsubscribe. Buckets are dropped for a subscriber that
+// falls behind.
+func (f *LiveFeed) Subscribe() (<-chan LiveBucket, func()) {
+	ch := make(chan LiveBucket, 64)
+	f.mu.Lock()
+	f.subs[ch] = struct{}{}
+	f.mu.Unlock()
+	return ch, func() {
+		f.mu.Lock()
+		delete(f.subs, ch)
+		f.mu.Unlock()
+	}
+}
+
+func (f *LiveFeed) subscribers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subs)
+}
+
+func (f *LiveFeed) publish(b LiveBucket) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs {
+		select {
+		case ch <- b:
+		default:
+		}
+	}
+}
+
+func (f *LiveFeed) Close() error {
+	close(f.done)
+	f.wg.Wait()
+	return nil
+}
+
+// Reconnect backoff and keepalive of ListenLive.
+const (
+	liveMinReconnect = time.Second
+	liveMaxReconnect = time.Minute
+	livePingInterval = 90 * time.Second
+)
+
+// ListenLive receives the buckets of the live sinks writing to the database
+// at dsn. The listener reconnects on its own, calling dsn again for every
+// connection so a rotated password applies; notifications sent while it is
+// disconnected are lost.
+func ListenLive(dsn func() string) (*LiveFeed, error) {
+	cn, notifications, err := listenLive(dsn())
+	if err != nil {
+		return nil, err
+	}
+
+	f := newLiveFeed()
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		for {
+			if !f.receive(cn, notifications) {
+				return
+			}
+			fmt.Printf("[ANALYTICS]: Live feed disconnected: %v\n", cn.Err())
+
+			wait := liveMinReconnect
+			for {
+				select {
+				case <-time.After(wait):
+				case <-f.done:
+					return
+				}
+				cn, notifications, err = listenLive(dsn())
+				if err == nil {
+					fmt.Println("[ANALYTICS]: Live feed reconnected")
+					break
+				}
+				fmt.Printf("[ANALYTICS]: Live feed: %v\n", err)
+				wait = min(wait*2, liveMaxReconnect)
+			}
+		}
+	}()
+	return f, nil
+}
+
+// listenLive connects to dsn and listens on LiveChannel.
+func listenLive(dsn string) (*pq.ListenerConn, <-chan *pq.Notification, error) {
+	notifications := make(chan *pq.Notification, 32)
+	cn, err := pq.NewListenerConn(dsn, notifications)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := cn.Listen(LiveChannel); err != nil {
+		cn.Close()
+		return nil, nil, err
+	}
+	return cn, notifications, nil
+}
+
+// receive publishes the notifications of cn until the connection is lost,
+// returning true, or the feed is closed, returning false. A ping every
+// livePingInterval detects connections dropped without notice.
+func (f *LiveFeed) receive(cn *pq.ListenerConn, notifications <-chan *pq.Notification) bool {
+	ping := time.NewTicker(livePingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case n, ok := <-notifications:
+			if !ok {
+				return true
+			}
+			var b LiveBucket
+			if err := json.Unmarshal([]byte(n.Extra), &b); err != nil {
+				fmt.Printf("[ANALYTICS]: Invalid live notification: %v\n", err)
+				continue
+			}
+			f.publish(b)
+		case <-ping.C:
+			if err := cn.Ping(); err != nil {
+				cn.Close()
+			}
+		case <-f.done:
+			cn.Close()
+			return false
+		}
+	}
+}
+
+// livePollInterval is how often Live reads new SQLite events.
+const livePollInterval = time.Second
+
+// Live polls the SQLite sink for new events while anyone is subscribed, as
+// SQLite has no notifications. Events show up once the server has flushed
+// them.
+func (s *SQLiteSource) Live() *LiveFeed {
+	f := newLiveFeed()
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		ticker := time.NewTicker(livePollInterval)
+		defer ticker.Stop()
+
+		var last int64 = -1
+		for {
+			select {
+			case <-ticker.C:
+			case <-f.done:
+				return
+			}
+			if f.subscribers() == 0 {
+				last = -1
+				continue
+			}
+			var err error
+			last, err = s.pollLive(f, last)
+			if err != nil {
+				fmt.Printf("[ANALYTICS]: Live feed: %v\n", err)
+			}
+		}
+	}()
+	return f
+}
+
+// pollLive publishes the events after id last and returns the last id read.
+// With last -1 it only finds the current last id.
+func (s *SQLiteSource) pollLive(f *LiveFeed, last int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), livePollInterval)
+	defer cancel()
+
+	if last < 0 {
+		err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM events`).Scan(&last)
+		if err != nil {
+			return -1, err
+		}
+		return last, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, timestamp, endpoint, status, country, continent
+		FROM events
+		WHERE id > $1
+		ORDER BY id
+		LIMIT 10000
+	`, last)
+	if err != nil {
+		return last, err
+	}
+	defer rows.Close()
+
+	var batch []Event
+	for rows.Next() {
+		var e Event
+		var ts int64
+		if err := rows.Scan(&last, &ts, &e.Endpoint, &e.Status, &e.Country, &e.Continent); err != nil {
+			return last, err
+		}
+		e.Timestamp = time.UnixMilli(ts)
+		batch = append(batch, e)
+	}
+	if err := rows.Err(); err != nil {
+		return last, err
+	}
+	for _, b := range liveBuckets(batch) {
+		f.publish(b)
+	}
+	return last, nil
+}
@@ -1,16 +1,28 @@
 package analytics
 
 import (
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
+
+	"altcha/pkg/apikey"
+	"altcha/pkg/handler"
+)
+
+// Echo context keys set by the access layer and recorded with each event.
+const (
+	ContextAccessAction = "access_action"
+	ContextAccessRule   = "access_rule"
 )
 
 func Middleware(collector *Collector) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			path := c.Path()
-			if path != "/challenge" && path != "/verify" {
+			if path != "/challenge" && path != "/verify" && path != "/forward-auth" {
 				return next(c)
 			}
 
@@ -18,15 +30,81 @@ func Middleware(collector *Collector) echo.MiddlewareFunc {
 			err := next(c)
 			latency := time.Since(start).Seconds() * 1000
 
-			collector.Record(Event{
+			e := Event{
 				Timestamp: start,
 				Endpoint:  path[1:], // strip leading /
 				ClientIP:  c.RealIP(),
 				Status:    c.Response().Status,
 				LatencyMs: latency,
-			})
+			}
+			if id, ok := c.Get(apikey.ContextKey).(string); ok && id != "" {
+				e.APIKey = &id
+			}
+			if action, ok := c.Get(ContextAccessAction).(string); ok && action != "" {
+				rule, _ := c.Get(ContextAccessRule).(string)
+				e.AccessAction, e.AccessRule = &action, &rule
+			}
+			if id, ok := c.Get(handler.ContextChallengeID).(string); ok && id != "" {
+				e.ChallengeID = &id
+			}
+			if path == "/challenge" {
+				if form := c.QueryParam("form"); validForm(form) {
+					e.Form = &form
+				}
+			}
+			if reason, ok := c.Get(handler.ContextVerifyReason).(string); ok && reason != "" {
+				e.Reason = &reason
+			}
+			// The algorithm of /verify comes from the payload.
+			if alg, ok := c.Get(handler.ContextAlgorithm).(string); ok && validForm(alg) {
+				e.Algorithm = &alg
+			}
+			if n, ok := c.Get(handler.ContextComplexity).(int); ok {
+				complexity := int64(n)
+				e.Complexity = &complexity
+			}
+			if origin := requestOrigin(c.Request()); origin != "" {
+				e.Origin = &origin
+			}
+			if family := UAFamily(c.Request().UserAgent()); family != "" {
+				e.UAFamily = &family
+			}
+			collector.Record(e)
 
 			return err
 		}
 	}
 }
+
+// requestOrigin returns the scheme and host of the Origin header, or of the
+// Referer when Origin is absent or opaque ("null"), in lower case.
+func requestOrigin(r *http.Request) string {
+	for _, v := range []string{r.Header.Get("Origin"), r.Referer()} {
+		if v == "" || v == "null" {
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(u.Host) > 255 {
+			continue
+		}
+		return u.Scheme + "://" + strings.ToLower(u.Host)
+	}
+	return ""
+}
+
+// validForm accepts short labels made of letters, digits, '.', '_' and '-', so
+// arbitrary query strings don't end up as dashboard rows.
+func validForm(s string) bool {
+	if s == "" || len(s) > 64 {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.', r == '_', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
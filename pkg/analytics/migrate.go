@@ -0,0 +1,212 @@
+package analytics
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are the files in migrations/, named <version>_<name>.sql and
+// applied in version order. Each runs in its own transaction together with
+// its schema_migrations row. Applied files must never change; add a new file
+// instead.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrateLockKey is the pg_advisory_lock key held while migrating, so replicas
+// starting together apply each migration once.
+const migrateLockKey = 0x616c746d6967
+
+type Migration struct {
+	Version int
+	Name    string
+	// AppliedAt is zero while the migration is pending.
+	AppliedAt time.Time
+
+	sql string
+}
+
+func loadMigrations() ([]Migration, error) {
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var ms []Migration
+	seen := map[int]string{}
+	for _, name := range names {
+		base := strings.TrimSuffix(path.Base(name), ".sql")
+		num, label, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: name must be <version>_<name>.sql", name)
+		}
+		if prev, dup := seen[version]; dup {
+			return nil, fmt.Errorf("migration %s: version %d already used by %s", name, version, prev)
+		}
+		seen[version] = name
+
+		data, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, Migration{Version: version, Name: label, sql: string(data)})
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	return ms, nil
+}
+
+const createMigrationsTable = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)
+`
+
+// Migrations returns every known migration with its AppliedAt set from
+// schema_migrations. It does not write, so it works with read-only roles.
+func Migrations(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	ms, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return ms, nil
+	}
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ms {
+		ms[i].AppliedAt = applied[ms[i].Version]
+	}
+	return ms, nil
+}
+
+func appliedMigrations(ctx context.Context, q queryer) (map[int]time.Time, error) {
+	rows, err := q.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// Pending returns the migrations not applied yet.
+func Pending(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	ms, err := Migrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, m := range ms {
+		if m.AppliedAt.IsZero() {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations in order and returns them. It holds
+// an advisory lock for the whole run, so a concurrent Migrate waits and then
+// finds nothing left to do.
+func Migrate(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	ms, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrateLockKey); err != nil {
+		return nil, fmt.Errorf("lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrateLockKey)
+
+	if _, err := conn.ExecContext(ctx, createMigrationsTable); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, m := range ms {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := applyMigration(ctx, conn, m); err != nil {
+			return done, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, m Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Without arguments lib/pq uses the simple query protocol, which accepts
+	// several statements at once.
+	if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.Version, m.Name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func checkSchema(db *sql.DB, autoMigrate bool) error {
+	ctx := context.Background()
+	if autoMigrate {
+		done, err := Migrate(ctx, db)
+		for _, m := range done {
+			fmt.Printf("[ANALYTICS]: Applied migration %04d_%s\n", m.Version, m.Name)
+		}
+		return err
+	}
+
+	pending, err := Pending(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%d pending migrations starting at %04d_%s; run \"altcha migrate\"",
+			len(pending), pending[0].Version, pending[0].Name)
+	}
+	return nil
+}
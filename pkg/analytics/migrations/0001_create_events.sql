@@ -0,0 +1,14 @@
+-- Migrations 0001-0004 use IF NOT EXISTS because databases created before
+-- schema_migrations existed already contain their objects.
+CREATE TABLE IF NOT EXISTS events (
+	id         BIGSERIAL PRIMARY KEY,
+	timestamp  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	endpoint   TEXT NOT NULL,
+	client_ip  TEXT NOT NULL,
+	status     INTEGER NOT NULL,
+	latency_ms DOUBLE PRECISION,
+	country    TEXT,
+	continent  TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_events_timestamp ON events (timestamp);
+CREATE INDEX IF NOT EXISTS idx_events_endpoint_timestamp ON events (endpoint, timestamp);
@@ -0,0 +1,3 @@
+ALTER TABLE events ADD COLUMN IF NOT EXISTS api_key TEXT;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS access_action TEXT;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS access_rule TEXT;
@@ -0,0 +1,3 @@
+ALTER TABLE events ADD COLUMN IF NOT EXISTS challenge_id TEXT;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS form TEXT;
+CREATE INDEX IF NOT EXISTS idx_events_challenge_id ON events (challenge_id) WHERE challenge_id IS NOT NULL;
@@ -0,0 +1,41 @@
+-- Watermarks of the rollup levels (see rollup.go).
+CREATE TABLE IF NOT EXISTS analytics_rollups (
+	name         TEXT PRIMARY KEY,
+	rolled_until TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS events_hourly (
+	bucket        TIMESTAMPTZ NOT NULL,
+	endpoint      TEXT NOT NULL,
+	status        INTEGER NOT NULL,
+	country       TEXT NOT NULL DEFAULT '',
+	continent     TEXT NOT NULL DEFAULT '',
+	requests      BIGINT NOT NULL,
+	latency_sum   DOUBLE PRECISION NOT NULL,
+	latency_count BIGINT NOT NULL,
+	PRIMARY KEY (bucket, endpoint, status, country, continent)
+);
+CREATE TABLE IF NOT EXISTS latency_hourly (
+	bucket TIMESTAMPTZ NOT NULL,
+	bin    INTEGER NOT NULL,
+	count  BIGINT NOT NULL,
+	PRIMARY KEY (bucket, bin)
+);
+
+CREATE TABLE IF NOT EXISTS events_daily (
+	bucket        TIMESTAMPTZ NOT NULL,
+	endpoint      TEXT NOT NULL,
+	status        INTEGER NOT NULL,
+	country       TEXT NOT NULL DEFAULT '',
+	continent     TEXT NOT NULL DEFAULT '',
+	requests      BIGINT NOT NULL,
+	latency_sum   DOUBLE PRECISION NOT NULL,
+	latency_count BIGINT NOT NULL,
+	PRIMARY KEY (bucket, endpoint, status, country, continent)
+);
+CREATE TABLE IF NOT EXISTS latency_daily (
+	bucket TIMESTAMPTZ NOT NULL,
+	bin    INTEGER NOT NULL,
+	count  BIGINT NOT NULL,
+	PRIMARY KEY (bucket, bin)
+);
@@ -0,0 +1,8 @@
+ALTER TABLE events ADD COLUMN reason TEXT;
+ALTER TABLE events ADD COLUMN algorithm TEXT;
+ALTER TABLE events ADD COLUMN complexity BIGINT;
+ALTER TABLE events ADD COLUMN origin TEXT;
+ALTER TABLE events ADD COLUMN ua_family TEXT;
+ALTER TABLE events ADD COLUMN asn BIGINT;
+ALTER TABLE events ADD COLUMN as_org TEXT;
+ALTER TABLE events ADD COLUMN city TEXT;
@@ -0,0 +1,223 @@
+package analytics
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IP modes of IPPolicy.
+const (
+	IPFull     = "full"
+	IPTruncate = "truncate"
+	IPHash     = "hash"
+	IPDrop     = "drop"
+)
+
+// IPPolicy decides how client_ip is stored. GeoIP lookups happen before it
+// applies, so country and continent are kept in every mode.
+type IPPolicy struct {
+	Mode string
+	// SaltPeriod and Salts are used by IPHash: addresses are hashed with a
+	// random salt that is replaced every SaltPeriod, so hashes of the same
+	// address only match within one period.
+	SaltPeriod time.Duration
+	Salts      *IPSalts
+}
+
+// IPSalts holds the random salt of the current period. It only lives in
+// memory and is dropped when the period ends, so a stored hash can't be
+// recomputed, not even by testing guessed addresses.
+type IPSalts struct {
+	mu     sync.Mutex
+	length time.Duration
+	period int64
+	salt   []byte
+}
+
+// get returns the salt for an event at t. Events of an earlier period, e.g.
+// flushed late, get the current salt.
+func (s *IPSalts) get(length time.Duration, t time.Time) []byte {
+	period := t.Unix() / int64(length/time.Second)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.salt == nil || length != s.length || period > s.period {
+		s.salt = make([]byte, 32)
+		rand.Read(s.salt)
+		s.length, s.period = length, period
+	}
+	return s.salt
+}
+
+// Apply returns the stored form of ip for an event at t. Values that are not
+// IP addresses, e.g. already anonymized ones, are kept by truncate and hash.
+func (p IPPolicy) Apply(ip string, t time.Time) string {
+	switch p.Mode {
+	case IPDrop:
+		return ""
+	case IPTruncate:
+		return truncateIP(ip)
+	case IPHash:
+		if net.ParseIP(ip) == nil {
+			return ip
+		}
+		// without salts the address is dropped rather than kept
+		if p.Salts == nil || p.SaltPeriod < time.Second {
+			return ""
+		}
+		return p.hash(ip, t)
+	default:
+		return ip
+	}
+}
+
+// ipNetwork returns the /24 network of an IPv4 address or the /48 network of
+// an IPv6 address and its prefix length, or nil when ip is not an address.
+func ipNetwork(ip string) (net.IP, int) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, 0
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)), 24
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)), 48
+}
+
+// truncateIP zeroes the host part of ip: IPv4 to /24, IPv6 to /48.
+func truncateIP(ip string) string {
+	network, _ := ipNetwork(ip)
+	if network == nil {
+		return ip
+	}
+	return network.String()
+}
+
+// subnetOf is the network of ip in CIDR notation, or "" when ip is not an
+// address.
+func subnetOf(ip string) string {
+	network, bits := ipNetwork(ip)
+	if network == nil {
+		return ""
+	}
+	return network.String() + "/" + strconv.Itoa(bits)
+}
+
+func (p IPPolicy) hash(ip string, t time.Time) string {
+	mac := hmac.New(sha256.New, p.Salts.get(p.SaltPeriod, t))
+	mac.Write([]byte(ip))
+	return "h:" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+const purgeIPsBatch = 1000
+
+// PurgeIPs rewrites the client_ip of the PostgreSQL events before the given
+// time with policy, for rows recorded under a weaker mode. It returns the
+// number of rows changed.
+func PurgeIPs(ctx context.Context, db *sql.DB, policy IPPolicy, before time.Time) (int64, error) {
+	return purgeIPs(ctx, db, postgres, policy, before)
+}
+
+// PurgeIPs is PurgeIPs for the SQLite sink.
+func (s *SQLiteSink) PurgeIPs(ctx context.Context, policy IPPolicy, before time.Time) (int64, error) {
+	return purgeIPs(ctx, s.db, sqliteDialect, policy, before)
+}
+
+// purgeIPs walks the events by id in batches, each updated in its own
+// transaction, so it can be interrupted and run again. The subnet follows the
+// new client_ip.
+func purgeIPs(ctx context.Context, db *sql.DB, d dialect, policy IPPolicy, before time.Time) (int64, error) {
+	if policy.Mode == IPFull {
+		return 0, nil
+	}
+
+	var changed int64
+	var last int64
+	for {
+		rows, err := db.QueryContext(ctx, `
+			SELECT id, client_ip, timestamp
+			FROM events
+			WHERE id > $1 AND timestamp < $2
+			ORDER BY id
+			LIMIT $3
+		`, last, d.timestamp(before), purgeIPsBatch)
+		if err != nil {
+			return changed, err
+		}
+
+		type update struct {
+			id int64
+			ip string
+		}
+		var updates []update
+		n := 0
+		for rows.Next() {
+			var id int64
+			var ip string
+			var ts interface{}
+			if err := rows.Scan(&id, &ip, &ts); err != nil {
+				rows.Close()
+				return changed, err
+			}
+			n++
+			last = id
+			at, err := scanTimestamp(ts)
+			if err != nil {
+				rows.Close()
+				return changed, err
+			}
+			if anon := policy.Apply(ip, at); anon != ip {
+				updates = append(updates, update{id, anon})
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return changed, err
+		}
+
+		if len(updates) > 0 {
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				return changed, err
+			}
+			for _, u := range updates {
+				var subnet *string
+				if s := subnetOf(u.ip); s != "" {
+					subnet = &s
+				}
+				if _, err := tx.ExecContext(ctx, `UPDATE events SET client_ip = $1, subnet = $2 WHERE id = $3`, u.ip, subnet, u.id); err != nil {
+					tx.Rollback()
+					return changed, err
+				}
+			}
+			if err := tx.Commit(); err != nil {
+				return changed, err
+			}
+			changed += int64(len(updates))
+		}
+		if n < purgeIPsBatch {
+			return changed, nil
+		}
+	}
+}
+
+// scanTimestamp converts a scanned events.timestamp for either database.
+func scanTimestamp(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case int64:
+		return time.UnixMilli(t), nil
+	default:
+		return time.Time{}, fmt.Errorf("unexpected timestamp %T", v)
+	}
+}
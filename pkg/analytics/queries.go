@@ -3,7 +3,10 @@ package analytics
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 type Summary struct {
@@ -11,19 +14,47 @@ type Summary struct {
 	Verified      int64   `json:"verified"`
 	Failed        int64   `json:"failed"`
 	AvgLatencyMs  float64 `json:"avg_latency_ms"`
+	P50LatencyMs  float64 `json:"p50_latency_ms"`
+	P95LatencyMs  float64 `json:"p95_latency_ms"`
+	P99LatencyMs  float64 `json:"p99_latency_ms"`
 	Errors4XX     int64   `json:"errors_4xx"`
 	Errors5XX     int64   `json:"errors_5xx"`
 	TotalRequests int64   `json:"total_requests"`
 }
 
 type TimeseriesPoint struct {
+	// Date is the start of the bucket in the requested time zone:
+	// 2006-01-02 for day and week buckets, 2006-01-02T15:04 otherwise.
 	Date       string  `json:"date"`
 	Challenges int64   `json:"challenges"`
 	Verified   int64   `json:"verified"`
 	Failed     int64   `json:"failed"`
 	AvgLatency float64 `json:"avg_latency"`
+	P50Latency float64 `json:"p50_latency"`
+	P95Latency float64 `json:"p95_latency"`
+	P99Latency float64 `json:"p99_latency"`
+}
+
+// Buckets are the bucket sizes accepted by QueryTimeseries, named after the
+// PostgreSQL date_trunc fields. Week buckets start on Monday.
+var Buckets = map[string]time.Duration{
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
 }
 
+// MaxTimeseriesPoints caps the number of buckets a single query may return,
+// e.g. 33 hours of minute buckets or 83 days of hour buckets.
+const MaxTimeseriesPoints = 2000
+
+// latencyPercentiles selects p50, p95 and p99 of latency_ms.
+const latencyPercentiles = `
+	COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY latency_ms), 0),
+	COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY latency_ms), 0),
+	COALESCE(percentile_cont(0.99) WITHIN GROUP (ORDER BY latency_ms), 0)
+`
+
 type LocationEntry struct {
 	Continent string  `json:"continent"`
 	Country   string  `json:"country"`
@@ -31,7 +62,17 @@ type LocationEntry struct {
 	Percent   float64 `json:"percent"`
 }
 
+// QuerySummary reads rollups for long ranges (see planRollup); latency
+// percentiles are then estimated from histograms.
 func QuerySummary(ctx context.Context, db *sql.DB, from, to time.Time) (*Summary, error) {
+	plan, err := planRollup(ctx, db, from, to, true)
+	if err != nil {
+		return nil, err
+	}
+	if plan != nil {
+		return querySummaryRollup(ctx, db, plan)
+	}
+
 	query := `
 		SELECT
 			COUNT(*) FILTER (WHERE endpoint = 'challenge') AS challenges,
@@ -40,14 +81,16 @@ func QuerySummary(ctx context.Context, db *sql.DB, from, to time.Time) (*Summary
 			COALESCE(AVG(latency_ms), 0) AS avg_latency_ms,
 			COUNT(*) FILTER (WHERE status >= 400 AND status < 500) AS errors_4xx,
 			COUNT(*) FILTER (WHERE status >= 500) AS errors_5xx,
-			COUNT(*) AS total_requests
+			COUNT(*) AS total_requests,
+	` + latencyPercentiles + `
 		FROM events
 		WHERE timestamp >= $1 AND timestamp < $2
 	`
 	var s Summary
-	err := db.QueryRowContext(ctx, query, from, to).Scan(
+	err = db.QueryRowContext(ctx, query, from, to).Scan(
 		&s.Challenges, &s.Verified, &s.Failed,
 		&s.AvgLatencyMs, &s.Errors4XX, &s.Errors5XX, &s.TotalRequests,
+		&s.P50LatencyMs, &s.P95LatencyMs, &s.P99LatencyMs,
 	)
 	if err != nil {
 		return nil, err
@@ -55,55 +98,220 @@ func QuerySummary(ctx context.Context, db *sql.DB, from, to time.Time) (*Summary
 	return &s, nil
 }
 
-func QueryTimeseries(ctx context.Context, db *sql.DB, from, to time.Time) ([]TimeseriesPoint, error) {
+func querySummaryRollup(ctx context.Context, db *sql.DB, plan *rollupPlan) (*Summary, error) {
 	query := `
 		SELECT
-			DATE(timestamp) AS date,
+			COALESCE(SUM(requests) FILTER (WHERE endpoint = 'challenge'), 0),
+			COALESCE(SUM(requests) FILTER (WHERE endpoint = 'verify' AND status = 202), 0),
+			COALESCE(SUM(requests) FILTER (WHERE endpoint = 'verify' AND status = 417), 0),
+			COALESCE(SUM(latency_sum) / NULLIF(SUM(latency_count), 0), 0),
+			COALESCE(SUM(requests) FILTER (WHERE status >= 400 AND status < 500), 0),
+			COALESCE(SUM(requests) FILTER (WHERE status >= 500), 0),
+			COALESCE(SUM(requests), 0)
+		FROM ` + plan.countsSQL()
+	var s Summary
+	err := db.QueryRowContext(ctx, query, plan.args()...).Scan(
+		&s.Challenges, &s.Verified, &s.Failed,
+		&s.AvgLatencyMs, &s.Errors4XX, &s.Errors5XX, &s.TotalRequests,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT bin, SUM(count) FROM `+plan.latencySQL()+` GROUP BY bin`,
+		append(plan.args(), pq.Array(latencyBounds))...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var h histogram
+	for rows.Next() {
+		var bin int
+		var n int64
+		if err := rows.Scan(&bin, &n); err != nil {
+			return nil, err
+		}
+		h = h.add(bin, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	s.P50LatencyMs, s.P95LatencyMs, s.P99LatencyMs = h.percentile(0.5), h.percentile(0.95), h.percentile(0.99)
+	return &s, nil
+}
+
+// QueryTimeseries groups events into buckets (see Buckets) that start at
+// local midnight, on the hour, etc. in loc.
+func QueryTimeseries(ctx context.Context, db *sql.DB, from, to time.Time, bucket string, loc *time.Location) ([]TimeseriesPoint, error) {
+	if _, ok := Buckets[bucket]; !ok {
+		return nil, fmt.Errorf("unknown bucket %q", bucket)
+	}
+
+	if bucket != "minute" {
+		// Daily rollups hold UTC days, so they only fit day and week buckets
+		// in UTC; other zones are bucketed from hourly rollups.
+		daily := (bucket == "day" || bucket == "week") && loc.String() == "UTC"
+		plan, err := planRollup(ctx, db, from, to, daily)
+		if err != nil {
+			return nil, err
+		}
+		if plan != nil {
+			return queryTimeseriesRollup(ctx, db, plan, bucket, loc)
+		}
+	}
+
+	query := `
+		SELECT
+			date_trunc($3, timestamp AT TIME ZONE $4) AS bucket,
 			COUNT(*) FILTER (WHERE endpoint = 'challenge') AS challenges,
 			COUNT(*) FILTER (WHERE endpoint = 'verify' AND status = 202) AS verified,
 			COUNT(*) FILTER (WHERE endpoint = 'verify' AND status = 417) AS failed,
-			COALESCE(AVG(latency_ms), 0) AS avg_latency
+			COALESCE(AVG(latency_ms), 0) AS avg_latency,
+	` + latencyPercentiles + `
 		FROM events
 		WHERE timestamp >= $1 AND timestamp < $2
-		GROUP BY DATE(timestamp)
-		ORDER BY date
+		GROUP BY bucket
+		ORDER BY bucket
 	`
-	rows, err := db.QueryContext(ctx, query, from, to)
+	rows, err := db.QueryContext(ctx, query, from, to, bucket, loc.String())
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	layout := bucketLayout(bucket)
+
 	var points []TimeseriesPoint
 	for rows.Next() {
 		var p TimeseriesPoint
+		// A timestamp without time zone: the wall clock in loc.
 		var d time.Time
-		if err := rows.Scan(&d, &p.Challenges, &p.Verified, &p.Failed, &p.AvgLatency); err != nil {
+		if err := rows.Scan(&d, &p.Challenges, &p.Verified, &p.Failed, &p.AvgLatency,
+			&p.P50Latency, &p.P95Latency, &p.P99Latency); err != nil {
 			return nil, err
 		}
-		p.Date = d.Format("2006-01-02")
+		p.Date = d.Format(layout)
 		points = append(points, p)
 	}
 	return points, rows.Err()
 }
 
-func QueryLocations(ctx context.Context, db *sql.DB, from, to time.Time) ([]LocationEntry, error) {
+func bucketLayout(bucket string) string {
+	if bucket == "day" || bucket == "week" {
+		return "2006-01-02"
+	}
+	return "2006-01-02T15:04"
+}
+
+func queryTimeseriesRollup(ctx context.Context, db *sql.DB, plan *rollupPlan, bucket string, loc *time.Location) ([]TimeseriesPoint, error) {
 	query := `
 		SELECT
-			COALESCE(continent, 'Unknown') AS continent,
-			COALESCE(country, 'Unknown') AS country,
-			COUNT(*) AS count
-		FROM events
-		WHERE timestamp >= $1 AND timestamp < $2
-		GROUP BY continent, country
-		ORDER BY count DESC
+			date_trunc($5, ts AT TIME ZONE $6) AS bucket,
+			COALESCE(SUM(requests) FILTER (WHERE endpoint = 'challenge'), 0),
+			COALESCE(SUM(requests) FILTER (WHERE endpoint = 'verify' AND status = 202), 0),
+			COALESCE(SUM(requests) FILTER (WHERE endpoint = 'verify' AND status = 417), 0),
+			COALESCE(SUM(latency_sum) / NULLIF(SUM(latency_count), 0), 0)
+		FROM ` + plan.countsSQL() + `
+		GROUP BY bucket
+		ORDER BY bucket
 	`
-	rows, err := db.QueryContext(ctx, query, from, to)
+	rows, err := db.QueryContext(ctx, query, append(plan.args(), bucket, loc.String())...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []TimeseriesPoint
+	index := map[time.Time]int{}
+	for rows.Next() {
+		var p TimeseriesPoint
+		var d time.Time
+		if err := rows.Scan(&d, &p.Challenges, &p.Verified, &p.Failed, &p.AvgLatency); err != nil {
+			return nil, err
+		}
+		p.Date = d.Format(bucketLayout(bucket))
+		index[d] = len(points)
+		points = append(points, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT date_trunc($6, ts AT TIME ZONE $7) AS bucket, bin, SUM(count)
+		FROM `+plan.latencySQL()+`
+		GROUP BY bucket, bin
+	`, append(plan.args(), pq.Array(latencyBounds), bucket, loc.String())...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	hists := make([]histogram, len(points))
+	for rows.Next() {
+		var d time.Time
+		var bin int
+		var n int64
+		if err := rows.Scan(&d, &bin, &n); err != nil {
+			return nil, err
+		}
+		if i, ok := index[d]; ok {
+			hists[i] = hists[i].add(bin, n)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i, h := range hists {
+		points[i].P50Latency, points[i].P95Latency, points[i].P99Latency = h.percentile(0.5), h.percentile(0.95), h.percentile(0.99)
+	}
+	return points, nil
+}
+
+func QueryLocations(ctx context.Context, db *sql.DB, from, to time.Time) ([]LocationEntry, error) {
+	plan, err := planRollup(ctx, db, from, to, true)
+	if err != nil {
+		return nil, err
+	}
+
+	query := rawLocationsQuery
+	args := []interface{}{from, to}
+	if plan != nil {
+		query = `
+			SELECT
+				COALESCE(continent, 'Unknown') AS continent,
+				COALESCE(country, 'Unknown') AS country,
+				SUM(requests) AS count
+			FROM ` + plan.countsSQL() + `
+			GROUP BY continent, country
+			ORDER BY count DESC
+		`
+		args = plan.args()
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanLocations(rows)
+}
+
+// rawLocationsQuery counts the events in [$1, $2) per country. It runs on
+// PostgreSQL and SQLite.
+const rawLocationsQuery = `
+	SELECT
+		COALESCE(continent, 'Unknown') AS continent,
+		COALESCE(country, 'Unknown') AS country,
+		COUNT(*) AS count
+	FROM events
+	WHERE timestamp >= $1 AND timestamp < $2
+	GROUP BY continent, country
+	ORDER BY count DESC
+`
+
+func scanLocations(rows *sql.Rows) ([]LocationEntry, error) {
+	defer rows.Close()
+
 	var entries []LocationEntry
 	var total int64
 	for rows.Next() {
@@ -0,0 +1,515 @@
+package analytics
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Rollups aggregate raw events into events_hourly/latency_hourly and those
+// into events_daily/latency_daily. Each level has a watermark in
+// analytics_rollups: everything before rolled_until has been aggregated, so
+// queries read rollups up to the watermark and raw events after it.
+const (
+	// rollupLag leaves time for events of the last hour to be flushed.
+	rollupLag      = 5 * time.Minute
+	rollupInterval = 5 * time.Minute
+	// rollupRecheck is how far behind the hourly watermark every run
+	// aggregates again, so events committed late (a sink retrying a batch,
+	// a replica with a slow clock) still reach the rollups. Raw events in
+	// this range are never purged.
+	rollupRecheck = 3 * time.Hour
+	// rollupChunk bounds the range aggregated per transaction, so the first
+	// run over an existing events table backfills it day by day.
+	rollupChunk = 24 * time.Hour
+	// rollupLockKey is the pg_try_advisory_xact_lock key held while rolling
+	// up, so only one replica works on a range.
+	rollupLockKey = 0x616c74636861
+
+	purgeBatch = 10000
+)
+
+// latencyBounds are the lower bounds in milliseconds of the latency histogram
+// bins after the first one (width_bucket semantics). Percentiles over rollups
+// are interpolated within these bins.
+var latencyBounds = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+type rollupLevel struct {
+	name    string
+	step    time.Duration
+	counts  string
+	latency string
+	// source selects (ts, endpoint, status, country, continent, requests,
+	// latency_sum, latency_count) and (ts, bin, count) for [$1, $2).
+	sourceCounts  string
+	sourceLatency string
+	// first returns the earliest source timestamp, NULL when empty.
+	first string
+	// after names the level whose watermark bounds this one, "" for raw events.
+	after string
+}
+
+var rollupLevels = []rollupLevel{
+	{
+		name:    "hourly",
+		step:    time.Hour,
+		counts:  "events_hourly",
+		latency: "latency_hourly",
+		sourceCounts: `
+			SELECT date_trunc('hour', timestamp, 'UTC'), endpoint, status,
+				COALESCE(country, ''), COALESCE(continent, ''),
+				COUNT(*), COALESCE(SUM(latency_ms), 0), COUNT(latency_ms)
+			FROM events
+			WHERE timestamp >= $1 AND timestamp < $2
+			GROUP BY 1, 2, 3, 4, 5`,
+		sourceLatency: `
+			SELECT date_trunc('hour', timestamp, 'UTC'), width_bucket(latency_ms, $3::float8[]), COUNT(*)
+			FROM events
+			WHERE timestamp >= $1 AND timestamp < $2 AND latency_ms IS NOT NULL
+			GROUP BY 1, 2`,
+		first: `SELECT MIN(timestamp) FROM events`,
+	},
+	{
+		name:    "daily",
+		step:    24 * time.Hour,
+		counts:  "events_daily",
+		latency: "latency_daily",
+		sourceCounts: `
+			SELECT date_trunc('day', bucket, 'UTC'), endpoint, status, country, continent,
+				SUM(requests), SUM(latency_sum), SUM(latency_count)
+			FROM events_hourly
+			WHERE bucket >= $1 AND bucket < $2
+			GROUP BY 1, 2, 3, 4, 5`,
+		sourceLatency: `
+			SELECT date_trunc('day', bucket, 'UTC'), bin, SUM(count)
+			FROM latency_hourly
+			WHERE bucket >= $1 AND bucket < $2
+			GROUP BY 1, 2`,
+		first: `SELECT MIN(bucket) FROM events_hourly`,
+		after: "hourly",
+	},
+}
+
+// Maintainer rolls up events and enforces the raw-event retention in the
+// background.
+type Maintainer struct {
+	db        *sql.DB
+	retention func() time.Duration
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewMaintainer starts rolling up every few minutes. retention is called
+// before each purge so a reloaded ANALYTICS_RETENTION_DAYS applies; 0 keeps raw
+// events.
+func NewMaintainer(db *sql.DB, retention func() time.Duration) *Maintainer {
+	m := &Maintainer{db: db, retention: retention, done: make(chan struct{})}
+	m.wg.Add(1)
+	go m.loop()
+	return m
+}
+
+func (m *Maintainer) Close() {
+	close(m.done)
+	m.wg.Wait()
+}
+
+func (m *Maintainer) loop() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(rollupInterval)
+	defer ticker.Stop()
+
+	for {
+		m.run()
+		select {
+		case <-ticker.C:
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *Maintainer) run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-m.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := Rollup(ctx, m.db, time.Now()); err != nil && ctx.Err() == nil {
+		fmt.Printf("[ANALYTICS]: Rollup failed: %v\n", err)
+		return
+	}
+	if r := m.retention(); r > 0 {
+		n, err := Purge(ctx, m.db, time.Now().Add(-r))
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("[ANALYTICS]: Retention purge failed: %v\n", err)
+		}
+		if n > 0 {
+			fmt.Printf("[ANALYTICS]: Deleted %d raw events older than %s\n", n, r)
+		}
+	}
+}
+
+// Rollup aggregates every complete hour and day up to now, after
+// aggregating the last rollupRecheck again. It returns early without error
+// when another replica holds the rollup lock.
+func Rollup(ctx context.Context, db *sql.DB, now time.Time) error {
+	for _, lvl := range rollupLevels {
+		if err := reaggregate(ctx, db, lvl); err != nil {
+			return fmt.Errorf("%s: %w", lvl.name, err)
+		}
+		for {
+			done, err := rollupChunkOnce(ctx, db, lvl, now)
+			if err != nil {
+				return fmt.Errorf("%s: %w", lvl.name, err)
+			}
+			if done {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// rollupChunkOnce aggregates up to rollupChunk past the level's watermark in
+// one transaction and reports whether the level is caught up.
+func rollupChunkOnce(ctx context.Context, db *sql.DB, lvl rollupLevel, now time.Time) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, rollupLockKey).Scan(&locked); err != nil {
+		return false, err
+	}
+	if !locked {
+		return true, nil
+	}
+
+	target := now.UTC().Add(-rollupLag).Truncate(lvl.step)
+	if lvl.after != "" {
+		upstream, ok, err := watermark(ctx, tx, lvl.after)
+		if err != nil || !ok {
+			return true, err
+		}
+		target = upstream.Truncate(lvl.step)
+	}
+
+	from, ok, err := watermark(ctx, tx, lvl.name)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		// First run: start at the oldest existing data.
+		var first sql.NullTime
+		if err := tx.QueryRowContext(ctx, lvl.first).Scan(&first); err != nil {
+			return false, err
+		}
+		from = target
+		if first.Valid {
+			from = first.Time.UTC().Truncate(lvl.step)
+		}
+	}
+	if !from.Before(target) {
+		if !ok {
+			return true, setWatermark(ctx, tx, lvl.name, target)
+		}
+		return true, nil
+	}
+
+	to := from.Add(rollupChunk)
+	if to.After(target) {
+		to = target
+	}
+
+	if err := aggregate(ctx, tx, lvl, from, to); err != nil {
+		return false, err
+	}
+	if err := setWatermark(ctx, tx, lvl.name, to); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return !to.Before(target), nil
+}
+
+// reaggregate aggregates the range behind the level's watermark that may
+// have received late events again: the last rollupRecheck for hourly, and
+// the days holding it for daily.
+func reaggregate(ctx context.Context, db *sql.DB, lvl rollupLevel) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, rollupLockKey).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+
+	to, ok, err := watermark(ctx, tx, lvl.name)
+	if err != nil || !ok {
+		return err
+	}
+	hourly, ok, err := watermark(ctx, tx, "hourly")
+	if err != nil || !ok {
+		return err
+	}
+	from := hourly.Add(-rollupRecheck).Truncate(lvl.step)
+	if !from.Before(to) {
+		return nil
+	}
+	if err := aggregate(ctx, tx, lvl, from, to); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// aggregate writes the rollups of [from, to), replacing the buckets already
+// there.
+func aggregate(ctx context.Context, tx *sql.Tx, lvl rollupLevel, from, to time.Time) error {
+	if _, err := tx.ExecContext(ctx, `INSERT INTO `+lvl.counts+`
+		(bucket, endpoint, status, country, continent, requests, latency_sum, latency_count)
+		`+lvl.sourceCounts+`
+		ON CONFLICT (bucket, endpoint, status, country, continent) DO UPDATE SET
+			requests = EXCLUDED.requests,
+			latency_sum = EXCLUDED.latency_sum,
+			latency_count = EXCLUDED.latency_count`, from, to); err != nil {
+		return err
+	}
+	args := []interface{}{from, to}
+	if lvl.after == "" {
+		args = append(args, pq.Array(latencyBounds))
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO `+lvl.latency+` (bucket, bin, count) `+lvl.sourceLatency+`
+		ON CONFLICT (bucket, bin) DO UPDATE SET count = EXCLUDED.count`, args...)
+	return err
+}
+
+// queryer is implemented by *sql.DB, *sql.Conn and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func watermark(ctx context.Context, q queryer, name string) (time.Time, bool, error) {
+	var t time.Time
+	err := q.QueryRowContext(ctx, `SELECT rolled_until FROM analytics_rollups WHERE name = $1`, name).Scan(&t)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, nil
+	}
+	return t.UTC(), err == nil, err
+}
+
+func setWatermark(ctx context.Context, tx *sql.Tx, name string, t time.Time) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO analytics_rollups (name, rolled_until) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET rolled_until = EXCLUDED.rolled_until
+	`, name, t)
+	return err
+}
+
+// Purge deletes raw events older than before in batches and returns how many
+// were deleted. Events that have not been rolled up yet, or are aggregated
+// again for late events (rollupRecheck), are kept.
+func Purge(ctx context.Context, db *sql.DB, before time.Time) (int64, error) {
+	rolled, ok, err := watermark(ctx, db, "hourly")
+	if err != nil || !ok {
+		return 0, err
+	}
+	if keep := rolled.Add(-rollupRecheck).Truncate(time.Hour); keep.Before(before) {
+		before = keep
+	}
+
+	var total int64
+	for {
+		res, err := db.ExecContext(ctx, `
+			DELETE FROM events WHERE id IN (
+				SELECT id FROM events WHERE timestamp < $1 LIMIT $2
+			)
+		`, before, purgeBatch)
+		if err != nil {
+			return total, err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+		if n < purgeBatch {
+			return total, nil
+		}
+
+		// Let the collector's inserts through between batches.
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return total, ctx.Err()
+		}
+	}
+}
+
+// rollupThreshold is the longest range read from raw events.
+const rollupThreshold = 48 * time.Hour
+
+// rollupPlan reads [start, until) from rollup tables and [from, start) and
+// [until, to) from raw events.
+type rollupPlan struct {
+	counts  string
+	latency string
+	from    time.Time
+	start   time.Time
+	until   time.Time
+	to      time.Time
+}
+
+// planRollup returns nil when [from, to) should be read from raw events only:
+// short ranges that raw events still cover, or when nothing is rolled up yet.
+// allowDaily permits the daily tables, whose buckets are UTC days; they are
+// used when from and to fall on UTC midnight.
+func planRollup(ctx context.Context, db *sql.DB, from, to time.Time, allowDaily bool) (*rollupPlan, error) {
+	var first sql.NullTime
+	if err := db.QueryRowContext(ctx, `SELECT MIN(timestamp) FROM events`).Scan(&first); err != nil {
+		return nil, err
+	}
+	if to.Sub(from) <= rollupThreshold && first.Valid && !from.Before(first.Time) {
+		return nil, nil
+	}
+
+	day := 24 * time.Hour
+	if allowDaily && from.UTC().Truncate(day).Equal(from) && to.UTC().Truncate(day).Equal(to) {
+		until, ok, err := watermark(ctx, db, "daily")
+		if err != nil {
+			return nil, err
+		}
+		if ok && until.After(from) {
+			return newRollupPlan("daily", from, from, until, to), nil
+		}
+	}
+
+	until, ok, err := watermark(ctx, db, "hourly")
+	if err != nil || !ok {
+		return nil, err
+	}
+	// Rollups cannot split an hour: a partial first hour is read from raw
+	// events, or from its rollup when they have been purged.
+	start := from.Truncate(time.Hour)
+	if start.Before(from) && first.Valid && !from.Before(first.Time) {
+		start = start.Add(time.Hour)
+	}
+	if !until.After(start) {
+		return nil, nil
+	}
+	return newRollupPlan("hourly", from, start, until, to), nil
+}
+
+func newRollupPlan(level string, from, start, until, to time.Time) *rollupPlan {
+	if until.After(to) {
+		until = to
+	}
+	return &rollupPlan{
+		counts:  "events_" + level,
+		latency: "latency_" + level,
+		from:    from,
+		start:   start,
+		until:   until,
+		to:      to,
+	}
+}
+
+// args are $1-$4 of countsSQL and latencySQL.
+func (p *rollupPlan) args() []interface{} {
+	return []interface{}{p.from, p.start, p.until, p.to}
+}
+
+// countsSQL is a subquery with the columns ts, endpoint, status, country,
+// continent, requests, latency_sum and latency_count over rollups and raw
+// events. It uses $1-$4 (see args).
+func (p *rollupPlan) countsSQL() string {
+	return `(
+		SELECT bucket AS ts, endpoint, status,
+			NULLIF(country, '') AS country, NULLIF(continent, '') AS continent,
+			requests, latency_sum, latency_count
+		FROM ` + p.counts + `
+		WHERE bucket >= $2 AND bucket < $3
+		UNION ALL
+		SELECT timestamp, endpoint, status, country, continent,
+			1, COALESCE(latency_ms, 0), CASE WHEN latency_ms IS NULL THEN 0 ELSE 1 END
+		FROM events
+		WHERE (timestamp >= $1 AND timestamp < $2) OR (timestamp >= $3 AND timestamp < $4)
+	) f`
+}
+
+// latencySQL is a subquery with the columns ts, bin and count over rollups
+// and raw events. It uses $1-$4 (see args) and the latencyBounds array in $5.
+func (p *rollupPlan) latencySQL() string {
+	return `(
+		SELECT bucket AS ts, bin, count
+		FROM ` + p.latency + `
+		WHERE bucket >= $2 AND bucket < $3
+		UNION ALL
+		SELECT timestamp, width_bucket(latency_ms, $5::float8[]), 1
+		FROM events
+		WHERE ((timestamp >= $1 AND timestamp < $2) OR (timestamp >= $3 AND timestamp < $4))
+			AND latency_ms IS NOT NULL
+	) l`
+}
+
+// histogram counts latencies per latencyBounds bin.
+type histogram []int64
+
+func (h histogram) add(bin int, n int64) histogram {
+	if h == nil {
+		h = make(histogram, len(latencyBounds)+1)
+	}
+	if bin >= 0 && bin < len(h) {
+		h[bin] += n
+	}
+	return h
+}
+
+// percentile interpolates linearly within the bin holding the q-quantile. The
+// last bin is open-ended and reports its lower bound.
+func (h histogram) percentile(q float64) float64 {
+	var total int64
+	for _, n := range h {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := q * float64(total)
+	var seen int64
+	for bin, n := range h {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		lower := 0.0
+		if bin > 0 {
+			lower = latencyBounds[bin-1]
+		}
+		if bin == len(latencyBounds) {
+			return lower
+		}
+		upper := latencyBounds[bin]
+		return lower + (upper-lower)*(rank-float64(seen))/float64(n)
+	}
+	return latencyBounds[len(latencyBounds)-1]
+}
@@ -0,0 +1,204 @@
+package analytics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Sink stores batches of events for the Collector. Write is called from a
+// single goroutine.
+type Sink interface {
+	Write(ctx context.Context, batch []Event) error
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// FanOut writes every batch to all sinks. A failing sink does not keep the
+// batch from the others.
+func FanOut(sinks ...Sink) Sink {
+	if len(sinks) == 1 {
+		return sinks[0]
+	}
+	return fanOut(sinks)
+}
+
+type fanOut []Sink
+
+func (f fanOut) Write(ctx context.Context, batch []Event) error {
+	var errs []error
+	for _, s := range f {
+		errs = append(errs, s.Write(ctx, batch))
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanOut) Ping(ctx context.Context) error {
+	var errs []error
+	for _, s := range f {
+		errs = append(errs, s.Ping(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanOut) Close() error {
+	var errs []error
+	for _, s := range f {
+		errs = append(errs, s.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// encodeNDJSON appends one JSON object per event and line to buf.
+func encodeNDJSON(buf *bytes.Buffer, batch []Event) error {
+	enc := json.NewEncoder(buf)
+	for _, e := range batch {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriterSink writes events as newline-delimited JSON to w, e.g. os.Stdout for
+// a log shipper. It does not close w.
+type WriterSink struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) Write(ctx context.Context, batch []Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buf.Reset()
+	if err := encodeNDJSON(&s.buf, batch); err != nil {
+		return err
+	}
+	_, err := s.w.Write(s.buf.Bytes())
+	return err
+}
+
+func (s *WriterSink) Ping(ctx context.Context) error { return nil }
+func (s *WriterSink) Close() error                   { return nil }
+
+// FileSink appends events as newline-delimited JSON to a file. When a batch
+// would grow the file past maxSize it is renamed to path.1, path.1 to path.2
+// and so on, and the oldest beyond maxBackups is removed.
+type FileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+	buf  bytes.Buffer
+}
+
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	s := &FileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+func (s *FileSink) Write(ctx context.Context, batch []Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		// A failed rotation left no open file.
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	s.buf.Reset()
+	if err := encodeNDJSON(&s.buf, batch); err != nil {
+		return err
+	}
+	if s.size > 0 && s.size+int64(s.buf.Len()) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("rotate %s: %w", s.path, err)
+		}
+	}
+	n, err := s.f.Write(s.buf.Bytes())
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) rotate() error {
+	err := s.f.Close()
+	s.f = nil
+	if err != nil {
+		return err
+	}
+	if s.maxBackups == 0 {
+		if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return s.open()
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileSink) Ping(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return fmt.Errorf("%s is not open", s.path)
+	}
+	_, err := s.f.Stat()
+	return err
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
@@ -0,0 +1,90 @@
+package analytics
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Source answers the dashboard queries from the database of a sink.
+type Source interface {
+	Summary(ctx context.Context, from, to time.Time) (*Summary, error)
+	// Timeseries takes a bucket of Buckets.
+	Timeseries(ctx context.Context, from, to time.Time, bucket string, loc *time.Location) ([]TimeseriesPoint, error)
+	Locations(ctx context.Context, from, to time.Time) ([]LocationEntry, error)
+	Funnel(ctx context.Context, from, to, pendingSince time.Time) (*FunnelReport, error)
+	SolveTimes(ctx context.Context, from, to time.Time) (*SolveTimes, error)
+	// Breakdown takes a dimension of Dimensions.
+	Breakdown(ctx context.Context, dimension string, from, to time.Time, limit int) ([]BreakdownEntry, error)
+	// Top takes a group of TopGroups and TopByVolume or TopByFailure.
+	Top(ctx context.Context, by, order string, from, to time.Time, limit, minVerifications int) ([]BreakdownEntry, error)
+	Anomalies(ctx context.Context, end time.Time, opts AnomalyOptions) (*AnomalyReport, error)
+	Ping(ctx context.Context) error
+}
+
+// PostgresSource reads the PostgreSQL sink, including its rollups.
+type PostgresSource struct {
+	db *sql.DB
+}
+
+func NewPostgresSource(db *sql.DB) *PostgresSource {
+	return &PostgresSource{db: db}
+}
+
+func (s *PostgresSource) Summary(ctx context.Context, from, to time.Time) (*Summary, error) {
+	return QuerySummary(ctx, s.db, from, to)
+}
+
+func (s *PostgresSource) Timeseries(ctx context.Context, from, to time.Time, bucket string, loc *time.Location) ([]TimeseriesPoint, error) {
+	return QueryTimeseries(ctx, s.db, from, to, bucket, loc)
+}
+
+func (s *PostgresSource) Locations(ctx context.Context, from, to time.Time) ([]LocationEntry, error) {
+	return QueryLocations(ctx, s.db, from, to)
+}
+
+func (s *PostgresSource) Funnel(ctx context.Context, from, to, pendingSince time.Time) (*FunnelReport, error) {
+	return QueryFunnel(ctx, s.db, from, to, pendingSince)
+}
+
+func (s *PostgresSource) SolveTimes(ctx context.Context, from, to time.Time) (*SolveTimes, error) {
+	return QuerySolveTimes(ctx, s.db, from, to)
+}
+
+func (s *PostgresSource) Breakdown(ctx context.Context, dimension string, from, to time.Time, limit int) ([]BreakdownEntry, error) {
+	return QueryBreakdown(ctx, s.db, dimension, from, to, limit)
+}
+
+func (s *PostgresSource) Top(ctx context.Context, by, order string, from, to time.Time, limit, minVerifications int) ([]BreakdownEntry, error) {
+	return QueryTop(ctx, s.db, by, order, from, to, limit, minVerifications)
+}
+
+func (s *PostgresSource) Anomalies(ctx context.Context, end time.Time, opts AnomalyOptions) (*AnomalyReport, error) {
+	return QueryAnomalies(ctx, s.db, end, opts)
+}
+
+func (s *PostgresSource) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// dialect is the SQL that differs between the queries shared by PostgreSQL
+// and SQLite.
+type dialect struct {
+	// percentile is the continuous percentile q of expr over the group.
+	percentile func(q float64, expr string) string
+	// seconds converts the difference of two timestamps to seconds.
+	seconds func(diff string) string
+	// timestamp converts t to the events.timestamp representation.
+	timestamp func(t time.Time) interface{}
+}
+
+var postgres = dialect{
+	percentile: func(q float64, expr string) string {
+		return fmt.Sprintf("percentile_cont(%g) WITHIN GROUP (ORDER BY %s)", q, expr)
+	},
+	seconds: func(diff string) string {
+		return "EXTRACT(EPOCH FROM " + diff + ")::float8"
+	},
+	timestamp: func(t time.Time) interface{} { return t },
+}
@@ -0,0 +1,340 @@
+package analytics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+// The SQLite sink stores timestamps as Unix milliseconds. It has no rollups,
+// so every query reads raw events.
+
+// sqliteMigrations are applied in order and tracked in PRAGMA user_version.
+// Append new statements; never edit applied ones.
+var sqliteMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS events (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp     INTEGER NOT NULL,
+		endpoint      TEXT NOT NULL,
+		client_ip     TEXT NOT NULL,
+		status        INTEGER NOT NULL,
+		latency_ms    REAL,
+		country       TEXT,
+		continent     TEXT,
+		api_key       TEXT,
+		access_action TEXT,
+		access_rule   TEXT,
+		challenge_id  TEXT,
+		form          TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_events_timestamp ON events (timestamp);
+	CREATE INDEX IF NOT EXISTS idx_events_endpoint_timestamp ON events (endpoint, timestamp);
+	CREATE INDEX IF NOT EXISTS idx_events_challenge_id ON events (challenge_id) WHERE challenge_id IS NOT NULL;`,
+	`ALTER TABLE events ADD COLUMN reason TEXT;
+	ALTER TABLE events ADD COLUMN algorithm TEXT;
+	ALTER TABLE events ADD COLUMN complexity INTEGER;
+	ALTER TABLE events ADD COLUMN origin TEXT;
+	ALTER TABLE events ADD COLUMN ua_family TEXT;
+	ALTER TABLE events ADD COLUMN asn INTEGER;
+	ALTER TABLE events ADD COLUMN as_org TEXT;
+	ALTER TABLE events ADD COLUMN city TEXT;`,
+	`ALTER TABLE events ADD COLUMN subnet TEXT;`,
+}
+
+// openSQLite opens the analytics database at path in WAL mode, so the
+// dashboard can read while the server writes, and brings its schema up to
+// date.
+func openSQLite(path string) (*sql.DB, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	return db, nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sqliteValues(e Event) []interface{} {
+	v := e.values()
+	v[0] = e.Timestamp.UnixMilli()
+	return v
+}
+
+// SQLiteSink stores events in a local SQLite database for single-node setups.
+// The dashboard reads it with DASHBOARD_SOURCE=sqlite.
+type SQLiteSink struct {
+	db *sql.DB
+}
+
+func NewSQLiteSink(path string) (*SQLiteSink, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteSink{db: db}, nil
+}
+
+func (s *SQLiteSink) Write(ctx context.Context, batch []Event) error {
+	return insertEvents(ctx, s.db, batch, sqliteValues)
+}
+
+func (s *SQLiteSink) Ping(ctx context.Context) error { return s.db.PingContext(ctx) }
+func (s *SQLiteSink) Close() error                   { return s.db.Close() }
+
+// SQLiteSource reads the SQLite sink.
+type SQLiteSource struct {
+	db *sql.DB
+}
+
+func NewSQLiteSource(path string) (*SQLiteSource, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteSource{db: db}, nil
+}
+
+var sqliteDialect = dialect{
+	percentile: func(q float64, expr string) string {
+		return fmt.Sprintf("altcha_percentile(%s, %g)", expr, q)
+	},
+	seconds: func(diff string) string {
+		return "(" + diff + ") / 1000.0"
+	},
+	timestamp: func(t time.Time) interface{} { return t.UnixMilli() },
+}
+
+func (s *SQLiteSource) Summary(ctx context.Context, from, to time.Time) (*Summary, error) {
+	query := `
+		SELECT
+			COUNT(*) FILTER (WHERE endpoint = 'challenge'),
+			COUNT(*) FILTER (WHERE endpoint = 'verify' AND status = 202),
+			COUNT(*) FILTER (WHERE endpoint = 'verify' AND status = 417),
+			COALESCE(AVG(latency_ms), 0),
+			COUNT(*) FILTER (WHERE status >= 400 AND status < 500),
+			COUNT(*) FILTER (WHERE status >= 500),
+			COUNT(*),
+			COALESCE(altcha_percentile(latency_ms, 0.5), 0),
+			COALESCE(altcha_percentile(latency_ms, 0.95), 0),
+			COALESCE(altcha_percentile(latency_ms, 0.99), 0)
+		FROM events
+		WHERE timestamp >= $1 AND timestamp < $2
+	`
+	var sum Summary
+	err := s.db.QueryRowContext(ctx, query, from.UnixMilli(), to.UnixMilli()).Scan(
+		&sum.Challenges, &sum.Verified, &sum.Failed,
+		&sum.AvgLatencyMs, &sum.Errors4XX, &sum.Errors5XX, &sum.TotalRequests,
+		&sum.P50LatencyMs, &sum.P95LatencyMs, &sum.P99LatencyMs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &sum, nil
+}
+
+func (s *SQLiteSource) Timeseries(ctx context.Context, from, to time.Time, bucket string, loc *time.Location) ([]TimeseriesPoint, error) {
+	if _, ok := Buckets[bucket]; !ok {
+		return nil, fmt.Errorf("unknown bucket %q", bucket)
+	}
+
+	// altcha_bucket returns the bucket label, which sorts like the bucket.
+	query := `
+		SELECT
+			altcha_bucket(timestamp, $3, $4) AS bucket,
+			COUNT(*) FILTER (WHERE endpoint = 'challenge'),
+			COUNT(*) FILTER (WHERE endpoint = 'verify' AND status = 202),
+			COUNT(*) FILTER (WHERE endpoint = 'verify' AND status = 417),
+			COALESCE(AVG(latency_ms), 0),
+			COALESCE(altcha_percentile(latency_ms, 0.5), 0),
+			COALESCE(altcha_percentile(latency_ms, 0.95), 0),
+			COALESCE(altcha_percentile(latency_ms, 0.99), 0)
+		FROM events
+		WHERE timestamp >= $1 AND timestamp < $2
+		GROUP BY bucket
+		ORDER BY bucket
+	`
+	rows, err := s.db.QueryContext(ctx, query, from.UnixMilli(), to.UnixMilli(), bucket, loc.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []TimeseriesPoint
+	for rows.Next() {
+		var p TimeseriesPoint
+		if err := rows.Scan(&p.Date, &p.Challenges, &p.Verified, &p.Failed, &p.AvgLatency,
+			&p.P50Latency, &p.P95Latency, &p.P99Latency); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+func (s *SQLiteSource) Locations(ctx context.Context, from, to time.Time) ([]LocationEntry, error) {
+	rows, err := s.db.QueryContext(ctx, rawLocationsQuery, from.UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	return scanLocations(rows)
+}
+
+func (s *SQLiteSource) Funnel(ctx context.Context, from, to, pendingSince time.Time) (*FunnelReport, error) {
+	return queryFunnel(ctx, s.db, from.UnixMilli(), to.UnixMilli(), pendingSince.UnixMilli())
+}
+
+func (s *SQLiteSource) SolveTimes(ctx context.Context, from, to time.Time) (*SolveTimes, error) {
+	return querySolveTimes(ctx, s.db, sqliteDialect, from.UnixMilli(), to.UnixMilli())
+}
+
+func (s *SQLiteSource) Breakdown(ctx context.Context, dimension string, from, to time.Time, limit int) ([]BreakdownEntry, error) {
+	return queryBreakdown(ctx, s.db, dimension, from.UnixMilli(), to.UnixMilli(), limit)
+}
+
+func (s *SQLiteSource) Top(ctx context.Context, by, order string, from, to time.Time, limit, minVerifications int) ([]BreakdownEntry, error) {
+	return queryTop(ctx, s.db, by, order, from.UnixMilli(), to.UnixMilli(), limit, minVerifications)
+}
+
+func (s *SQLiteSource) Anomalies(ctx context.Context, end time.Time, opts AnomalyOptions) (*AnomalyReport, error) {
+	return queryAnomalies(ctx, s.db, sqliteDialect, end, opts)
+}
+
+func (s *SQLiteSource) Ping(ctx context.Context) error { return s.db.PingContext(ctx) }
+func (s *SQLiteSource) Close() error                   { return s.db.Close() }
+
+// SQLite lacks time zones and percentiles, so the queries use Go functions
+// registered for every SQLite connection of the process.
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("altcha_bucket", 3, sqliteBucket)
+	sqlite.MustRegisterFunction("altcha_percentile", &sqlite.FunctionImpl{
+		NArgs:         2,
+		Deterministic: true,
+		MakeAggregate: func(ctx sqlite.FunctionContext) (sqlite.AggregateFunction, error) {
+			return &percentileAgg{}, nil
+		},
+	})
+}
+
+var locations sync.Map // time zone name -> *time.Location
+
+// sqliteBucket is altcha_bucket(ms, bucket, tz): the label of the bucket of
+// Buckets containing the Unix millisecond timestamp ms in time zone tz, as
+// QueryTimeseries formats it.
+func sqliteBucket(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	ms, ok := args[0].(int64)
+	if !ok {
+		return nil, nil
+	}
+	bucket, _ := args[1].(string)
+	tz, _ := args[2].(string)
+
+	loc, ok := locations.Load(tz)
+	if !ok {
+		l, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, err
+		}
+		loc, _ = locations.LoadOrStore(tz, l)
+	}
+
+	t := time.UnixMilli(ms).In(loc.(*time.Location))
+	y, m, d := t.Date()
+	switch bucket {
+	case "minute":
+		t = time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, t.Location())
+	case "hour":
+		t = time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location())
+	case "day":
+		t = time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	case "week":
+		// Weeks start on Monday, like date_trunc('week', ...).
+		t = time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location())
+	default:
+		return nil, fmt.Errorf("unknown bucket %q", bucket)
+	}
+	return t.Format(bucketLayout(bucket)), nil
+}
+
+// percentileAgg is altcha_percentile(x, q), which interpolates like
+// percentile_cont(q) WITHIN GROUP (ORDER BY x) and ignores NULLs.
+type percentileAgg struct {
+	values []float64
+	q      float64
+}
+
+func (a *percentileAgg) Step(ctx *sqlite.FunctionContext, args []driver.Value) error {
+	switch v := args[1].(type) {
+	case float64:
+		a.q = v
+	case int64:
+		a.q = float64(v)
+	}
+	switch v := args[0].(type) {
+	case float64:
+		a.values = append(a.values, v)
+	case int64:
+		a.values = append(a.values, float64(v))
+	}
+	return nil
+}
+
+func (a *percentileAgg) WindowInverse(ctx *sqlite.FunctionContext, args []driver.Value) error {
+	return fmt.Errorf("altcha_percentile cannot be used as a window function")
+}
+
+func (a *percentileAgg) WindowValue(ctx *sqlite.FunctionContext) (driver.Value, error) {
+	if len(a.values) == 0 {
+		return nil, nil
+	}
+	sort.Float64s(a.values)
+	pos := a.q * float64(len(a.values)-1)
+	lo := int(math.Floor(pos))
+	if lo+1 >= len(a.values) {
+		return a.values[len(a.values)-1], nil
+	}
+	return a.values[lo] + (pos-float64(lo))*(a.values[lo+1]-a.values[lo]), nil
+}
+
+func (a *percentileAgg) Final(ctx *sqlite.FunctionContext) {}
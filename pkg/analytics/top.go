@@ -0,0 +1,79 @@
+package analytics
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// TopGroups are the groupings of QueryTop, described like Dimensions. Events
+// without a value are left out.
+var TopGroups = map[string]breakdownDimension{
+	"ip":      {value: "NULLIF(client_ip, '')", label: "COALESCE(MAX(country), '')"},
+	"subnet":  {value: "subnet", label: "COALESCE(MAX(country), '')"},
+	"asn":     {value: "CAST(asn AS TEXT)", label: "COALESCE(MAX(as_org), '')"},
+	"country": {value: "country", label: "COALESCE(MAX(continent), '')"},
+}
+
+// Orders of QueryTop.
+const (
+	// TopByVolume ranks by challenges issued.
+	TopByVolume = "volume"
+	// TopByFailure ranks by the failure rate of verifications, among groups
+	// with at least the given number of them.
+	TopByFailure = "failure"
+)
+
+// QueryTop returns the limit groups of by (one of TopGroups) ranked by order.
+// minVerifications is the least number of verifications a group needs to be
+// ranked by failure rate, at least 1. It reads raw events.
+func QueryTop(ctx context.Context, db *sql.DB, by, order string, from, to time.Time, limit, minVerifications int) ([]BreakdownEntry, error) {
+	return queryTop(ctx, db, by, order, from, to, limit, minVerifications)
+}
+
+// queryTop takes the bounds in the representation of the events.timestamp
+// column.
+func queryTop(ctx context.Context, db *sql.DB, by, order string, from, to interface{}, limit, minVerifications int) ([]BreakdownEntry, error) {
+	group, ok := TopGroups[by]
+	if !ok {
+		return nil, fmt.Errorf("unknown group %q", by)
+	}
+	if limit <= 0 || limit > MaxBreakdownRows {
+		limit = MaxBreakdownRows
+	}
+
+	settled := `COUNT(*) FILTER (WHERE ` + verifiedCond + ` OR ` + failedCond + `)`
+	having := ""
+	var orderBy string
+	switch order {
+	case TopByVolume:
+		orderBy = "challenges DESC, requests DESC, value"
+	case TopByFailure:
+		if minVerifications < 1 {
+			minVerifications = 1
+		}
+		having = fmt.Sprintf("HAVING %s >= %d", settled, minVerifications)
+		orderBy = `COUNT(*) FILTER (WHERE ` + failedCond + `) * 1.0 / ` + settled + ` DESC, failed DESC, value`
+	default:
+		return nil, fmt.Errorf("unknown order %q", order)
+	}
+
+	query := `
+		SELECT
+			` + group.value + ` AS value,
+			` + group.label + `,
+			` + outcomeCounts + `
+		FROM events
+		WHERE timestamp >= $1 AND timestamp < $2 AND ` + group.value + ` IS NOT NULL
+		GROUP BY ` + group.value + `
+		` + having + `
+		ORDER BY ` + orderBy + `
+		LIMIT $3
+	`
+	rows, err := db.QueryContext(ctx, query, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanBreakdown(rows)
+}
@@ -0,0 +1,60 @@
+package analytics
+
+import "strings"
+
+// uaFamilies are matched in order against the lower-cased User-Agent, so
+// browsers whose User-Agent contains another browser's token (Edge and Opera
+// contain "chrome/", Chrome contains "safari/") come first.
+var uaFamilies = []struct {
+	token, family string
+}{
+	{"bot/", "Bot"},
+	{"bot;", "Bot"},
+	{"bot-", "Bot"},
+	{"crawler", "Bot"},
+	{"spider", "Bot"},
+	{"+http", "Bot"},
+	{"headlesschrome", "Headless Chrome"},
+	{"puppeteer", "Headless Chrome"},
+	{"playwright", "Playwright"},
+	{"phantomjs", "PhantomJS"},
+	{"edg/", "Edge"},
+	{"edge/", "Edge"},
+	{"opr/", "Opera"},
+	{"opera", "Opera"},
+	{"samsungbrowser", "Samsung Internet"},
+	{"yabrowser", "Yandex Browser"},
+	{"firefox/", "Firefox"},
+	{"fxios", "Firefox"},
+	{"crios", "Chrome"},
+	{"chrome/", "Chrome"},
+	{"chromium/", "Chrome"},
+	{"safari/", "Safari"},
+	{"curl/", "curl"},
+	{"wget/", "Wget"},
+	{"python", "Python"},
+	{"aiohttp", "Python"},
+	{"go-http-client", "Go"},
+	{"node", "Node.js"},
+	{"undici", "Node.js"},
+	{"axios", "Node.js"},
+	{"okhttp", "Java"},
+	{"java/", "Java"},
+	{"postmanruntime", "Postman"},
+}
+
+// UAFamily classifies a User-Agent into a browser or client family, so the
+// dashboard groups a handful of families instead of every version string.
+// Unrecognized agents are "Other" and an empty one is "".
+func UAFamily(ua string) string {
+	if ua == "" {
+		return ""
+	}
+	ua = strings.ToLower(ua)
+	for _, f := range uaFamilies {
+		if strings.Contains(ua, f.token) {
+			return f.family
+		}
+	}
+	return "Other"
+}
@@ -0,0 +1,119 @@
+package apikey
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Key identifies a backend service allowed to call /verify.
+type Key struct {
+	ID        string  `json:"id"`
+	Key       string  `json:"key,omitempty"`
+	SHA256    string  `json:"sha256,omitempty"`
+	RateLimit float64 `json:"rate_limit,omitempty"`
+
+	limiter *rate.Limiter
+}
+
+type keyFile struct {
+	Keys []Key `json:"keys"`
+}
+
+type Keyring struct {
+	mu     sync.RWMutex
+	byHash map[string]*Key
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{byHash: make(map[string]*Key)}
+}
+
+// LoadFile reads a JSON key file of the form
+//
+//	{"keys": [{"id": "billing", "key": "...", "rate_limit": 20}]}
+//
+// Either "key" (plain text) or "sha256" (hex digest of the key) must be set.
+func LoadFile(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f keyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	kr := NewKeyring()
+	for i := range f.Keys {
+		if err := kr.add(&f.Keys[i]); err != nil {
+			return nil, fmt.Errorf("%s: key #%d: %w", path, i+1, err)
+		}
+	}
+	if len(kr.byHash) == 0 {
+		return nil, fmt.Errorf("%s: no keys defined", path)
+	}
+	return kr, nil
+}
+
+func (kr *Keyring) add(k *Key) error {
+	if k.ID == "" {
+		return fmt.Errorf("missing id")
+	}
+
+	var hash string
+	switch {
+	case k.Key != "":
+		hash = hashKey(k.Key)
+	case k.SHA256 != "":
+		hash = strings.ToLower(k.SHA256)
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid sha256 for %q", k.ID)
+		}
+	default:
+		return fmt.Errorf("%q has neither key nor sha256", k.ID)
+	}
+	k.Key = ""
+
+	if k.RateLimit > 0 {
+		burst := int(k.RateLimit)
+		if burst < 1 {
+			burst = 1
+		}
+		k.limiter = rate.NewLimiter(rate.Limit(k.RateLimit), burst)
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if _, dup := kr.byHash[hash]; dup {
+		return fmt.Errorf("duplicate key for %q", k.ID)
+	}
+	kr.byHash[hash] = k
+	return nil
+}
+
+func (kr *Keyring) Lookup(secret string) (*Key, bool) {
+	if secret == "" {
+		return nil, false
+	}
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	k, ok := kr.byHash[hashKey(secret)]
+	return k, ok
+}
+
+func (k *Key) Allow() bool {
+	return k.limiter == nil || k.limiter.Allow()
+}
+
+func hashKey(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,60 @@
+package apikey
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"altcha/pkg/metrics"
+)
+
+// ContextKey is the echo context key holding the ID of the authenticated key.
+const ContextKey = "api_key_id"
+
+var (
+	acceptedTotal = metrics.NewCounterVec("altcha_verify_api_key_accepted_total",
+		"Requests to /verify authenticated with an API key.", "key")
+	rejectedTotal = metrics.NewCounterVec("altcha_verify_api_key_rejected_total",
+		"Requests to /verify rejected by API key authentication.", "reason", "key")
+)
+
+func Middleware(kr *Keyring) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			secret := KeyFromRequest(c.Request())
+			if secret == "" {
+				rejectedTotal.Inc("missing", "")
+				return c.NoContent(http.StatusUnauthorized)
+			}
+
+			key, ok := kr.Lookup(secret)
+			if !ok {
+				rejectedTotal.Inc("invalid", "")
+				return c.NoContent(http.StatusUnauthorized)
+			}
+
+			c.Set(ContextKey, key.ID)
+
+			if !key.Allow() {
+				rejectedTotal.Inc("rate_limited", key.ID)
+				return c.NoContent(http.StatusTooManyRequests)
+			}
+
+			acceptedTotal.Inc(key.ID)
+			return next(c)
+		}
+	}
+}
+
+// KeyFromRequest returns the key from the X-API-Key header or an
+// Authorization: Bearer header.
+func KeyFromRequest(r *http.Request) string {
+	if v := r.Header.Get("X-API-Key"); v != "" {
+		return v
+	}
+	if v := r.Header.Get("Authorization"); len(v) > 7 && strings.EqualFold(v[:7], "Bearer ") {
+		return strings.TrimSpace(v[7:])
+	}
+	return ""
+}
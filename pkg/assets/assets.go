@@ -0,0 +1,145 @@
+package assets
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"altcha/web"
+)
+
+// Assets serves the embedded web assets. Files found in the optional override
+// directory take precedence, which allows custom themes without rebuilding.
+type Assets struct {
+	fsys fs.FS
+
+	mu    sync.Mutex
+	etags map[string]etagEntry
+}
+
+type etagEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+func New(overrideDir string) *Assets {
+	var fsys fs.FS = web.FS
+	if overrideDir != "" {
+		fsys = overlayFS{upper: os.DirFS(overrideDir), lower: web.FS}
+	}
+	return &Assets{fsys: fsys, etags: make(map[string]etagEntry)}
+}
+
+func (a *Assets) FS() fs.FS {
+	return a.fsys
+}
+
+// File serves a single asset, e.g. "demo/index.html".
+func (a *Assets) File(name string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return a.serve(c, name)
+	}
+}
+
+// Handler serves the directory dir, mapping the "*" route parameter to a file
+// and directories to their index.html.
+func (a *Assets) Handler(dir string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := strings.TrimPrefix(path.Clean("/"+c.Param("*")), "/")
+		if name == "" {
+			name = "index.html"
+		}
+		return a.serve(c, path.Join(dir, name))
+	}
+}
+
+func (a *Assets) serve(c echo.Context, name string) error {
+	data, info, err := a.read(name)
+	if errors.Is(err, errIsDir) {
+		data, info, err = a.read(path.Join(name, "index.html"))
+		name = path.Join(name, "index.html")
+	}
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return echo.ErrNotFound
+		}
+		return err
+	}
+
+	h := c.Response().Header()
+	h.Set("ETag", a.etag(name, info, data))
+	if strings.HasSuffix(name, ".html") {
+		h.Set("Cache-Control", "no-cache")
+	} else {
+		h.Set("Cache-Control", "public, max-age=3600")
+	}
+
+	http.ServeContent(c.Response(), c.Request(), path.Base(name), info.ModTime(), bytes.NewReader(data))
+	return nil
+}
+
+var errIsDir = errors.New("is a directory")
+
+func (a *Assets) read(name string) ([]byte, fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, nil, fs.ErrNotExist
+	}
+
+	f, err := a.fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		return nil, nil, errIsDir
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, info, nil
+}
+
+func (a *Assets) etag(name string, info fs.FileInfo, data []byte) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if e, ok := a.etags[name]; ok && e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+		return e.etag
+	}
+
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	a.etags[name] = etagEntry{size: info.Size(), modTime: info.ModTime(), etag: etag}
+	return etag
+}
+
+type overlayFS struct {
+	upper fs.FS
+	lower fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if f, err := o.upper.Open(name); err == nil {
+		return f, nil
+	}
+	return o.lower.Open(name)
+}
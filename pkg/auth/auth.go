@@ -17,14 +17,14 @@ type Provider interface {
 	RegisterRoutes(e *echo.Echo)
 }
 
-func NewProvider(cfg *config.Config) Provider {
-	switch cfg.AuthProvider {
+func NewProvider(h *config.Holder) Provider {
+	switch h.Get().AuthProvider {
 	case "keycloak":
-		return NewOIDCProvider(cfg)
+		return NewOIDCProvider(h)
 	case "basic":
-		return NewBasicProvider(cfg)
+		return NewBasicProvider(h)
 	default:
-		return NewBasicProvider(cfg)
+		return NewBasicProvider(h)
 	}
 }
 
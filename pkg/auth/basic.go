@@ -10,24 +10,25 @@ import (
 )
 
 type BasicProvider struct {
-	cfg *config.Config
+	config *config.Holder
 }
 
-func NewBasicProvider(cfg *config.Config) *BasicProvider {
-	return &BasicProvider{cfg: cfg}
+func NewBasicProvider(h *config.Holder) *BasicProvider {
+	return &BasicProvider{config: h}
 }
 
 func (p *BasicProvider) Middleware() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
+			cfg := p.config.Get()
 			user, pass, ok := c.Request().BasicAuth()
 			if !ok {
 				c.Response().Header().Set("WWW-Authenticate", `Basic realm="ALTCHA Dashboard"`)
 				return c.String(http.StatusUnauthorized, "Unauthorized")
 			}
 
-			userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(p.cfg.AuthUsername)) == 1
-			passMatch := subtle.ConstantTimeCompare([]byte(pass), []byte(p.cfg.AuthPassword)) == 1
+			userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(cfg.AuthUsername)) == 1
+			passMatch := subtle.ConstantTimeCompare([]byte(pass), []byte(cfg.AuthPassword)) == 1
 
 			if !userMatch || !passMatch {
 				c.Response().Header().Set("WWW-Authenticate", `Basic realm="ALTCHA Dashboard"`)
@@ -35,7 +36,7 @@ func (p *BasicProvider) Middleware() echo.MiddlewareFunc {
 			}
 
 			userInfo := &UserInfo{Username: user}
-			if !IsAuthorized(userInfo, p.cfg) {
+			if !IsAuthorized(userInfo, cfg) {
 				return c.String(http.StatusForbidden, "Forbidden")
 			}
 
@@ -22,7 +22,7 @@ import (
 )
 
 type OIDCProvider struct {
-	cfg          *config.Config
+	config       *config.Holder
 	sessions     *SessionStore
 	discovery    *oidcDiscovery
 	jwksCache    *jwksCache
@@ -50,9 +50,9 @@ type jwksCache struct {
 	uri  string
 }
 
-func NewOIDCProvider(cfg *config.Config) *OIDCProvider {
+func NewOIDCProvider(h *config.Holder) *OIDCProvider {
 	p := &OIDCProvider{
-		cfg:          cfg,
+		config:       h,
 		sessions:     NewSessionStore(),
 		pendingState: make(map[string]*authState),
 		jwksCache:    &jwksCache{keys: make(map[string]interface{})},
@@ -102,10 +102,12 @@ func (p *OIDCProvider) ensureDiscovery() error {
 		return nil
 	}
 
+	cfg := p.config.Get()
+
 	disco := &oidcDiscovery{}
 
 	// Fetch from well-known endpoint
-	wellKnown := strings.TrimSuffix(p.cfg.AuthIssuer, "/") + "/.well-known/openid-configuration"
+	wellKnown := strings.TrimSuffix(cfg.AuthIssuer, "/") + "/.well-known/openid-configuration"
 	resp, err := http.Get(wellKnown)
 	if err != nil {
 		return fmt.Errorf("fetch OIDC discovery: %w", err)
@@ -120,17 +122,17 @@ func (p *OIDCProvider) ensureDiscovery() error {
 	}
 
 	// Allow env overrides
-	if p.cfg.AuthAuthorizationEndpoint != "" {
-		disco.AuthorizationEndpoint = p.cfg.AuthAuthorizationEndpoint
+	if cfg.AuthAuthorizationEndpoint != "" {
+		disco.AuthorizationEndpoint = cfg.AuthAuthorizationEndpoint
 	}
-	if p.cfg.AuthTokenEndpoint != "" {
-		disco.TokenEndpoint = p.cfg.AuthTokenEndpoint
+	if cfg.AuthTokenEndpoint != "" {
+		disco.TokenEndpoint = cfg.AuthTokenEndpoint
 	}
-	if p.cfg.AuthEndSessionEndpoint != "" {
-		disco.EndSessionEndpoint = p.cfg.AuthEndSessionEndpoint
+	if cfg.AuthEndSessionEndpoint != "" {
+		disco.EndSessionEndpoint = cfg.AuthEndSessionEndpoint
 	}
-	if p.cfg.AuthJWKSURI != "" {
-		disco.JWKSURI = p.cfg.AuthJWKSURI
+	if cfg.AuthJWKSURI != "" {
+		disco.JWKSURI = cfg.AuthJWKSURI
 	}
 
 	p.discovery = disco
@@ -139,6 +141,8 @@ func (p *OIDCProvider) ensureDiscovery() error {
 }
 
 func (p *OIDCProvider) redirectToLogin(c echo.Context) error {
+	cfg := p.config.Get()
+
 	if err := p.ensureDiscovery(); err != nil {
 		return c.String(http.StatusInternalServerError, "OIDC discovery failed: "+err.Error())
 	}
@@ -170,7 +174,7 @@ func (p *OIDCProvider) redirectToLogin(c echo.Context) error {
 
 	params := url.Values{
 		"response_type":         {"code"},
-		"client_id":             {p.cfg.AuthClientID},
+		"client_id":             {cfg.AuthClientID},
 		"redirect_uri":          {callbackURL},
 		"scope":                 {"openid profile"},
 		"state":                 {state},
@@ -182,6 +186,8 @@ func (p *OIDCProvider) redirectToLogin(c echo.Context) error {
 }
 
 func (p *OIDCProvider) handleCallback(c echo.Context) error {
+	cfg := p.config.Get()
+
 	if err := p.ensureDiscovery(); err != nil {
 		return c.String(http.StatusInternalServerError, "OIDC discovery failed")
 	}
@@ -215,11 +221,11 @@ func (p *OIDCProvider) handleCallback(c echo.Context) error {
 		"grant_type":    {"authorization_code"},
 		"code":          {code},
 		"redirect_uri":  {callbackURL},
-		"client_id":     {p.cfg.AuthClientID},
+		"client_id":     {cfg.AuthClientID},
 		"code_verifier": {as.CodeVerifier},
 	}
-	if p.cfg.AuthClientSecret != "" {
-		formData.Set("client_secret", p.cfg.AuthClientSecret)
+	if cfg.AuthClientSecret != "" {
+		formData.Set("client_secret", cfg.AuthClientSecret)
 	}
 
 	resp, err := http.PostForm(p.discovery.TokenEndpoint, formData)
@@ -249,7 +255,7 @@ func (p *OIDCProvider) handleCallback(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "Failed to verify ID token: "+err.Error())
 	}
 
-	if !IsAuthorized(userInfo, p.cfg) {
+	if !IsAuthorized(userInfo, cfg) {
 		return c.String(http.StatusForbidden, "Access denied")
 	}
 
@@ -273,6 +279,8 @@ func (p *OIDCProvider) handleCallback(c echo.Context) error {
 }
 
 func (p *OIDCProvider) handleLogout(c echo.Context) error {
+	cfg := p.config.Get()
+
 	cookie, err := c.Cookie("altcha_session")
 	if err == nil && cookie.Value != "" {
 		p.sessions.Delete(cookie.Value)
@@ -288,7 +296,7 @@ func (p *OIDCProvider) handleLogout(c echo.Context) error {
 
 	if p.discovery != nil && p.discovery.EndSessionEndpoint != "" {
 		params := url.Values{
-			"client_id":                {p.cfg.AuthClientID},
+			"client_id":                {cfg.AuthClientID},
 			"post_logout_redirect_uri": {fmt.Sprintf("https://%s/", c.Request().Host)},
 		}
 		return c.Redirect(http.StatusFound, p.discovery.EndSessionEndpoint+"?"+params.Encode())
@@ -298,6 +306,8 @@ func (p *OIDCProvider) handleLogout(c echo.Context) error {
 }
 
 func (p *OIDCProvider) parseIDToken(tokenString string) (*UserInfo, error) {
+	cfg := p.config.Get()
+
 	// Parse without verification first to get kid
 	unverified, _, err := jwt.NewParser().ParseUnverified(tokenString, jwt.MapClaims{})
 	if err != nil {
@@ -319,7 +329,7 @@ func (p *OIDCProvider) parseIDToken(tokenString string) (*UserInfo, error) {
 			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
 		}
 		return key, nil
-	}, jwt.WithIssuer(p.cfg.AuthIssuer))
+	}, jwt.WithIssuer(cfg.AuthIssuer))
 	if err != nil {
 		return nil, fmt.Errorf("verify token: %w", err)
 	}
@@ -360,6 +370,8 @@ func (p *OIDCProvider) parseIDToken(tokenString string) (*UserInfo, error) {
 }
 
 func (p *OIDCProvider) refreshTokens(sessionID string, session *Session) error {
+	cfg := p.config.Get()
+
 	if err := p.ensureDiscovery(); err != nil {
 		return err
 	}
@@ -367,10 +379,10 @@ func (p *OIDCProvider) refreshTokens(sessionID string, session *Session) error {
 	formData := url.Values{
 		"grant_type":    {"refresh_token"},
 		"refresh_token": {session.RefreshToken},
-		"client_id":     {p.cfg.AuthClientID},
+		"client_id":     {cfg.AuthClientID},
 	}
-	if p.cfg.AuthClientSecret != "" {
-		formData.Set("client_secret", p.cfg.AuthClientSecret)
+	if cfg.AuthClientSecret != "" {
+		formData.Set("client_secret", cfg.AuthClientSecret)
 	}
 
 	resp, err := http.PostForm(p.discovery.TokenEndpoint, formData)
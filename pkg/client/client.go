@@ -0,0 +1,226 @@
+// Package client verifies altcha payloads from Go services, either by calling
+// GET /verify on the ALTCHA server or offline with the shared secret.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Reasons of a Result, the same as the server's.
+const (
+	ReasonOK      = "ok"
+	ReasonMissing = "missing"
+	ReasonReplay  = "replay"
+	ReasonExpired = "expired"
+	ReasonInvalid = "invalid"
+)
+
+// ErrUnavailable is returned when the server could not be reached, kept
+// answering 5xx after all retries, or the circuit breaker is open.
+var ErrUnavailable = errors.New("altcha: verification server unavailable")
+
+// StatusError is returned when the server refuses the request itself, e.g.
+// 401 for a missing API key or 429 when the key's rate limit is exceeded. It
+// never triggers fail-open.
+type StatusError struct {
+	Status int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("altcha: server responded %d", e.Status)
+}
+
+type Options struct {
+	// BaseURL of the server exposing /verify, e.g. http://altcha-internal:3001.
+	BaseURL string
+	// APIKey is sent as X-API-Key when set (VERIFY_API_KEYS_FILE).
+	APIKey string
+
+	// Timeout per attempt. Default 2s.
+	Timeout time.Duration
+	// Retries after a network error or 5xx. Default 2; -1 disables retries.
+	Retries int
+	// Backoff before the first retry, doubled for each further one. Default 100ms.
+	Backoff time.Duration
+
+	// BreakerFailures is the number of consecutive failed verifications
+	// (after retries) that opens the circuit breaker. Default 5; -1 disables it.
+	BreakerFailures int
+	// BreakerCooldown is how long the breaker stays open before a single
+	// trial request is let through. Default 30s.
+	BreakerCooldown time.Duration
+
+	// FailOpen accepts payloads while the server is unavailable instead of
+	// returning ErrUnavailable. The Result is marked FailOpen.
+	FailOpen bool
+
+	// Secret enables offline verification: payloads are checked locally with
+	// the server's SECRET and BaseURL is not used. Replay protection is
+	// limited to this process and remembers the last MaxRecords payloads.
+	Secret     string
+	MaxRecords int
+
+	// HTTPClient overrides the client used for requests.
+	HTTPClient *http.Client
+}
+
+// Result of a verification. Reason is one of the server reasons (ok,
+// missing, invalid, expired, replay); /verify does not tell failures apart,
+// so remote failures are reported as invalid.
+type Result struct {
+	Verified bool
+	Reason   string
+	// FailOpen is set when the payload was accepted without verification
+	// because the server was unavailable.
+	FailOpen bool
+}
+
+// Verifier is safe for concurrent use.
+type Verifier struct {
+	opts    Options
+	http    *http.Client
+	breaker *breaker
+
+	seen *replayCache // offline only
+}
+
+func New(opts Options) (*Verifier, error) {
+	if opts.Secret == "" && opts.BaseURL == "" {
+		return nil, errors.New("altcha: BaseURL or Secret is required")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 2 * time.Second
+	}
+	if opts.Retries == 0 {
+		opts.Retries = 2
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 100 * time.Millisecond
+	}
+	if opts.BreakerFailures == 0 {
+		opts.BreakerFailures = 5
+	}
+	if opts.BreakerCooldown <= 0 {
+		opts.BreakerCooldown = 30 * time.Second
+	}
+	if opts.MaxRecords <= 0 {
+		opts.MaxRecords = 10000
+	}
+
+	v := &Verifier{opts: opts, http: opts.HTTPClient}
+	if v.http == nil {
+		v.http = &http.Client{}
+	}
+	if opts.BreakerFailures > 0 {
+		v.breaker = &breaker{threshold: opts.BreakerFailures, cooldown: opts.BreakerCooldown}
+	}
+	if opts.Secret != "" {
+		v.seen = newReplayCache(opts.MaxRecords)
+	}
+	return v, nil
+}
+
+// Verify checks payload. An error is returned when the payload could not be
+// checked: ErrUnavailable (unless FailOpen), a *StatusError, or ctx's error.
+func (v *Verifier) Verify(ctx context.Context, payload string) (Result, error) {
+	if payload == "" {
+		return Result{Reason: ReasonMissing}, nil
+	}
+	if v.seen != nil {
+		return verifyOffline(v.opts.Secret, v.seen, payload), nil
+	}
+
+	if v.breaker != nil && !v.breaker.allow() {
+		return v.unavailable(ErrUnavailable)
+	}
+
+	res, err := v.verifyRemote(ctx, payload)
+	var se *StatusError
+	rejected := errors.As(err, &se)
+	if v.breaker != nil {
+		v.breaker.record(err == nil || rejected)
+	}
+	if rejected {
+		return Result{}, err
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return Result{}, ctx.Err()
+		}
+		return v.unavailable(fmt.Errorf("%w: %v", ErrUnavailable, err))
+	}
+	return res, nil
+}
+
+func (v *Verifier) unavailable(err error) (Result, error) {
+	if v.opts.FailOpen {
+		return Result{Verified: true, FailOpen: true}, nil
+	}
+	return Result{}, err
+}
+
+func (v *Verifier) verifyRemote(ctx context.Context, payload string) (Result, error) {
+	u := strings.TrimSuffix(v.opts.BaseURL, "/") + "/verify?altcha=" + url.QueryEscape(payload)
+
+	var lastErr error
+	backoff := v.opts.Backoff
+	for attempt := 0; attempt <= max(v.opts.Retries, 0); attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return Result{}, ctx.Err()
+			}
+			backoff *= 2
+		}
+
+		status, err := v.do(ctx, u)
+		switch {
+		case err != nil:
+			lastErr = err
+		case status == http.StatusAccepted:
+			return Result{Verified: true, Reason: ReasonOK}, nil
+		case status == http.StatusExpectationFailed:
+			return Result{Reason: ReasonInvalid}, nil
+		case status >= 500:
+			lastErr = fmt.Errorf("server responded %d", status)
+		default:
+			// 401/429 and anything unexpected will not improve with a retry.
+			return Result{}, &StatusError{Status: status}
+		}
+		if ctx.Err() != nil {
+			return Result{}, ctx.Err()
+		}
+	}
+	return Result{}, lastErr
+}
+
+func (v *Verifier) do(ctx context.Context, u string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, v.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	if v.opts.APIKey != "" {
+		req.Header.Set("X-API-Key", v.opts.APIKey)
+	}
+	resp, err := v.http.Do(req)
+	if err != nil {
+		// Drop the URL, which carries the payload.
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			return 0, ue.Err
+		}
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type contextKey struct{}
+
+// FromContext returns the Result stored by the middleware.
+func FromContext(ctx context.Context) (Result, bool) {
+	res, ok := ctx.Value(contextKey{}).(Result)
+	return res, ok
+}
+
+// check verifies the form field of r and returns the status to answer with,
+// or 0 when the request may continue.
+func (v *Verifier) check(r *http.Request, field string) (*http.Request, int) {
+	if field == "" {
+		field = "altcha"
+	}
+	res, err := v.Verify(r.Context(), r.FormValue(field))
+	if err != nil {
+		return r, http.StatusServiceUnavailable
+	}
+	if !res.Verified {
+		return r, http.StatusForbidden
+	}
+	return r.WithContext(context.WithValue(r.Context(), contextKey{}, res)), 0
+}
+
+// Middleware verifies the altcha form field (default "altcha") of every
+// request. Invalid payloads get 403 and an unavailable server 503.
+func (v *Verifier) Middleware(field string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, status := v.check(r, field)
+			if status != 0 {
+				http.Error(w, http.StatusText(status), status)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// EchoMiddleware is Middleware for echo.
+func (v *Verifier) EchoMiddleware(field string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r, status := v.check(c.Request(), field)
+			if status != 0 {
+				return c.NoContent(status)
+			}
+			c.SetRequest(r)
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	altcha "github.com/altcha-org/altcha-lib-go"
+)
+
+// verifyOffline checks payload with secret the way the server's /verify
+// does, and remembers it in seen.
+func verifyOffline(secret string, seen *replayCache, payload string) Result {
+	var decoded altcha.Payload
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(data, &decoded) != nil {
+		return Result{Reason: ReasonInvalid}
+	}
+	if v := altcha.ExtractParams(decoded).Get("expires"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && time.Now().Unix() > n {
+			return Result{Reason: ReasonExpired}
+		}
+	}
+	// checked and recorded at once, so concurrent calls can't both pass
+	if !seen.add(payload) {
+		return Result{Reason: ReasonReplay}
+	}
+	if ok, err := altcha.VerifySolution(decoded, secret, true); err != nil || !ok {
+		return Result{Reason: ReasonInvalid}
+	}
+	return Result{Verified: true, Reason: ReasonOK}
+}
+
+// replayCache remembers the last max payloads, dropping the oldest first.
+type replayCache struct {
+	mu    sync.Mutex
+	max   int
+	order []string
+	set   map[string]struct{}
+}
+
+func newReplayCache(max int) *replayCache {
+	return &replayCache{max: max, set: make(map[string]struct{}, max)}
+}
+
+// add records payload and reports whether it was new.
+func (c *replayCache) add(payload string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.set[payload]; ok {
+		return false
+	}
+	c.set[payload] = struct{}{}
+	c.order = append(c.order, payload)
+	if len(c.order) > c.max {
+		delete(c.set, c.order[0])
+		c.order = c.order[1:]
+	}
+	return true
+}
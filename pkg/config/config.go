@@ -1,149 +1,378 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"os"
-	"strconv"
 	"strings"
+	"time"
 )
 
+const DefaultSecret = "$ecret.key"
+
+// Config holds the settings read by Load. The env tag names the setting;
+// "secret" marks values that are never logged and "restart" marks values that
+// are only read at startup and therefore ignored by Holder.Reload.
 type Config struct {
-	Port          int
-	Secret        string
-	Algorithm     string
-	ExpireMinutes int
-	MaxNumber     int
-	MaxRecords    int
-	CorsOrigin    []string
-	Demo          bool
-	LogLevel      string
-	RateLimit     float64
-	Store        string
-	SQLitePath   string
-	RedisURL     string
-	RedisCluster bool
-	DemoPort     int
+	Environment   string   `env:"ENVIRONMENT"`
+	Port          int      `env:"PORT,restart"`
+	Secret        string   `env:"SECRET,secret"`
+	Algorithm     string   `env:"ALGORITHM"`
+	ExpireMinutes int      `env:"EXPIREMINUTES"`
+	MaxNumber     int      `env:"COMPLEXITY"`
+	MaxRecords    int      `env:"MAXRECORDS,restart"`
+	CorsOrigin    []string `env:"CORS_ORIGIN"`
+	Demo          bool     `env:"DEMO,restart"`
+	LogLevel      string   `env:"LOG_LEVEL,restart"`
+	RateLimit     float64  `env:"RATE_LIMIT"`
+	Store         string   `env:"STORE,restart"`
+	SQLitePath    string   `env:"SQLITE_PATH,restart"`
+	RedisURL      string   `env:"REDIS_URL,secret"`
+	RedisCluster  bool     `env:"REDIS_CLUSTER,restart"`
+	DemoPort      int      `env:"DEMO_PORT,restart"`
+	InternalPort  int      `env:"INTERNAL_PORT,restart"`
+	WebDir        string   `env:"WEB_DIR,restart"`
+
+	// TrustedProxies are the IPs and CIDRs whose X-Forwarded-For header is
+	// believed. Without any the client IP is the address of the connection.
+	TrustedProxies []string `env:"TRUSTED_PROXIES,restart"`
+
+	// Verify API keys
+	VerifyAPIKeysFile string `env:"VERIFY_API_KEYS_FILE,restart"`
+
+	// Forward auth
+	ForwardAuthHeader string `env:"FORWARD_AUTH_HEADER"`
+	ForwardAuthCookie string `env:"FORWARD_AUTH_COOKIE"`
+	ForwardAuthField  string `env:"FORWARD_AUTH_FIELD"`
+
+	// Gate (reverse proxy)
+	GateUpstream string   `env:"GATE_UPSTREAM,restart"`
+	GatePort     int      `env:"GATE_PORT,restart"`
+	GateRules    []string `env:"GATE_RULES,restart"`
+	GateAction   string   `env:"GATE_ACTION"`
+	GateHeader   string   `env:"GATE_HEADER"`
+	GateField    string   `env:"GATE_FIELD"`
+
+	GateClearanceRules   []string `env:"GATE_CLEARANCE_RULES,restart"`
+	GateClearanceMinutes int      `env:"GATE_CLEARANCE_MINUTES"`
+
+	// Access control
+	AccessRules       []string `env:"ACCESS_RULES,restart"`
+	AccessRaiseFactor int      `env:"ACCESS_RAISE_FACTOR"`
 
 	// Analytics
-	PostgresURL string
-	GeoIPDB     string
+	PostgresURL string `env:"POSTGRES_URL,secret"`
+	GeoIPDB     string `env:"GEOIP_DB,restart"`
+	GeoIPASNDB  string `env:"GEOIP_ASN_DB,restart"`
+	GeoIPCityDB string `env:"GEOIP_CITY_DB,restart"`
+
+	// AnalyticsSinks receive every event: postgres, sqlite, file (NDJSON),
+	// stdout or live (PostgreSQL notifications for the dashboard's live
+	// view). Defaults to postgres and live when POSTGRES_URL is set.
+	AnalyticsSinks          []string `env:"ANALYTICS_SINKS,restart"`
+	AnalyticsSQLitePath     string   `env:"ANALYTICS_SQLITE_PATH,restart"`
+	AnalyticsFilePath       string   `env:"ANALYTICS_FILE_PATH,restart"`
+	AnalyticsFileMaxMB      int      `env:"ANALYTICS_FILE_MAX_MB,restart"`
+	AnalyticsFileMaxBackups int      `env:"ANALYTICS_FILE_MAX_BACKUPS,restart"`
+
+	// AnalyticsIPMode is how client IPs are stored: full, truncate (/24, /48),
+	// hash (with a random salt replaced every AnalyticsIPSaltHours) or drop.
+	AnalyticsIPMode      string `env:"ANALYTICS_IP_MODE"`
+	AnalyticsIPSaltHours int    `env:"ANALYTICS_IP_SALT_HOURS"`
+
+	// Raw events older than this are deleted once rolled up; 0 keeps them.
+	AnalyticsRetentionDays int `env:"ANALYTICS_RETENTION_DAYS"`
+	// When false the server refuses to start with pending schema migrations
+	// instead of applying them (see "altcha migrate").
+	AnalyticsAutoMigrate bool `env:"ANALYTICS_AUTO_MIGRATE,restart"`
 
 	// Dashboard
-	DashboardPort int
+	DashboardPort int `env:"DASHBOARD_PORT,restart"`
+	// DashboardSource is the database the dashboard reads: postgres or sqlite
+	// (ANALYTICS_SQLITE_PATH).
+	DashboardSource string `env:"DASHBOARD_SOURCE,restart"`
+	// AlertRulesFile enables alerting in the dashboard (see pkg/alert).
+	AlertRulesFile string `env:"ALERT_RULES_FILE,restart"`
+
+	// Admin API
+	AdminPort        int    `env:"ADMIN_PORT,restart"`
+	AdminAPIKeysFile string `env:"ADMIN_API_KEYS_FILE,restart"`
+	AdminAuditLog    string `env:"ADMIN_AUDIT_LOG,restart"`
 
 	// Auth
-	AuthProvider              string
-	AuthUsername              string
-	AuthPassword              string
-	AuthIssuer                string
-	AuthClientID              string
-	AuthClientSecret          string
-	AuthPKCE                  bool
-	AuthAuthorizationEndpoint string
-	AuthTokenEndpoint         string
-	AuthEndSessionEndpoint    string
-	AuthJWKSURI               string
-	AuthAllowedUsers          []string
-	AuthAllowedGroups         []string
-	AuthAllowedRoles          []string
+	AuthProvider              string   `env:"AUTH_PROVIDER,restart"`
+	AuthUsername              string   `env:"AUTH_USERNAME"`
+	AuthPassword              string   `env:"AUTH_PASSWORD,secret"`
+	AuthIssuer                string   `env:"AUTH_ISSUER,restart"`
+	AuthClientID              string   `env:"AUTH_CLIENT_ID"`
+	AuthClientSecret          string   `env:"AUTH_CLIENT_SECRET,secret"`
+	AuthPKCE                  bool     `env:"AUTH_PKCE"`
+	AuthAuthorizationEndpoint string   `env:"AUTH_AUTHORIZATION_ENDPOINT,restart"`
+	AuthTokenEndpoint         string   `env:"AUTH_TOKEN_ENDPOINT,restart"`
+	AuthEndSessionEndpoint    string   `env:"AUTH_END_SESSION_ENDPOINT,restart"`
+	AuthJWKSURI               string   `env:"AUTH_JWKS_URI,restart"`
+	AuthAllowedUsers          []string `env:"AUTH_ALLOWED_USERS"`
+	AuthAllowedGroups         []string `env:"AUTH_ALLOWED_GROUPS"`
+	AuthAllowedRoles          []string `env:"AUTH_ALLOWED_ROLES"`
+
+	// Set by Holder.RotateSecret: payloads signed with the previous secret
+	// keep verifying until PreviousSecretUntil.
+	PreviousSecret      string
+	PreviousSecretUntil time.Time
+}
+
+func (c *Config) IsProduction() bool {
+	return c.Environment == "production"
 }
 
 func (c *Config) IsDebug() bool {
 	return strings.EqualFold(c.LogLevel, "debug")
 }
 
+func (c *Config) InternalEnabled() bool {
+	return c.InternalPort > 0
+}
+
+func (c *Config) GateEnabled() bool {
+	return c.GateUpstream != ""
+}
+
+func (c *Config) AdminEnabled() bool {
+	return c.AdminPort > 0
+}
+
+// Secrets returns the secrets a payload may be signed with, current first.
+func (c *Config) Secrets() []string {
+	if c.PreviousSecret != "" && time.Now().Before(c.PreviousSecretUntil) {
+		return []string{c.Secret, c.PreviousSecret}
+	}
+	return []string{c.Secret}
+}
+
+// TrustedProxyNets parses TrustedProxies; a bare IP is a single-address
+// network. Invalid entries are left out (validate reports them).
+func (c *Config) TrustedProxyNets() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, v := range c.TrustedProxies {
+		if n, err := parseNet(v); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+func parseNet(v string) (*net.IPNet, error) {
+	if ip := net.ParseIP(v); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(v)
+	return n, err
+}
+
 func (c *Config) AnalyticsEnabled() bool {
-	return c.PostgresURL != ""
+	return len(c.AnalyticsSinks) > 0
 }
 
-func Load() *Config {
+// AnalyticsIPSaltPeriod is how long a salt of ANALYTICS_IP_MODE=hash is used.
+func (c *Config) AnalyticsIPSaltPeriod() time.Duration {
+	return time.Duration(c.AnalyticsIPSaltHours) * time.Hour
+}
+
+// AnalyticsRetention is how long raw analytics events are kept, 0 for ever.
+func (c *Config) AnalyticsRetention() time.Duration {
+	return time.Duration(c.AnalyticsRetentionDays) * 24 * time.Hour
+}
+
+// Load reads the configuration from environment variables and, when
+// CONFIG_FILE is set, from a YAML file whose keys are the environment
+// variable names (case-insensitive). Environment variables take precedence.
+// Every invalid or unknown setting is reported in the returned error.
+func Load() (*Config, error) {
+	return load(nil)
+}
+
+// load is Load with runtime overrides that take precedence over everything.
+func load(overrides map[string]string) (*Config, error) {
+	l, err := newLoader(os.Getenv("CONFIG_FILE"), overrides)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+	l.known["CONFIG_FILE"] = true
+
 	cfg := &Config{
-		Port:          envInt("PORT", 3000),
-		Secret:        envStr("SECRET", "$ecret.key"),
-		Algorithm:     envStr("ALGORITHM", "SHA-256"),
-		ExpireMinutes: envInt("EXPIREMINUTES", 10),
-		MaxNumber:     envInt("COMPLEXITY", 1000000),
-		MaxRecords:    envInt("MAXRECORDS", 1000),
-		CorsOrigin:    envList("CORS_ORIGIN", nil),
-		Demo:          envBool("DEMO", false),
-		LogLevel:      envStr("LOG_LEVEL", "info"),
-		RateLimit:     envFloat("RATE_LIMIT", 0),
-		Store:         envStr("STORE", "memory"),
-		SQLitePath:    envStr("SQLITE_PATH", "data/altcha.db"),
-		RedisURL:      envStr("REDIS_URL", "redis://localhost:6379"),
-		RedisCluster:  envBool("REDIS_CLUSTER", false),
-		DemoPort:      envInt("DEMO_PORT", 8000),
+		Environment:   l.str("ENVIRONMENT", "development"),
+		Port:          l.int("PORT", 3000),
+		Secret:        l.secret("SECRET", DefaultSecret),
+		Algorithm:     l.str("ALGORITHM", "SHA-256"),
+		ExpireMinutes: l.int("EXPIREMINUTES", 10),
+		MaxNumber:     l.int("COMPLEXITY", 1000000),
+		MaxRecords:    l.int("MAXRECORDS", 1000),
+		CorsOrigin:    l.list("CORS_ORIGIN", nil),
+		Demo:          l.bool("DEMO", false),
+		LogLevel:      l.str("LOG_LEVEL", "info"),
+		RateLimit:     l.float("RATE_LIMIT", 0),
+		Store:         l.str("STORE", "memory"),
+		SQLitePath:    l.str("SQLITE_PATH", "data/altcha.db"),
+		RedisURL:      l.secret("REDIS_URL", "redis://localhost:6379"),
+		RedisCluster:  l.bool("REDIS_CLUSTER", false),
+		DemoPort:      l.int("DEMO_PORT", 8000),
+		InternalPort:  l.int("INTERNAL_PORT", 0),
+		WebDir:        l.str("WEB_DIR", ""),
+
+		TrustedProxies: l.list("TRUSTED_PROXIES", nil),
+
+		// Verify API keys
+		VerifyAPIKeysFile: l.str("VERIFY_API_KEYS_FILE", ""),
+
+		// Forward auth
+		ForwardAuthHeader: l.str("FORWARD_AUTH_HEADER", "X-Altcha"),
+		ForwardAuthCookie: l.str("FORWARD_AUTH_COOKIE", "altcha"),
+		ForwardAuthField:  l.str("FORWARD_AUTH_FIELD", "altcha"),
+
+		// Gate (reverse proxy)
+		GateUpstream: l.str("GATE_UPSTREAM", ""),
+		GatePort:     l.int("GATE_PORT", 8080),
+		GateRules:    l.list("GATE_RULES", nil),
+		GateAction:   l.str("GATE_ACTION", "deny"),
+		GateHeader:   l.str("GATE_HEADER", "X-Altcha"),
+		GateField:    l.str("GATE_FIELD", "altcha"),
+
+		GateClearanceRules:   l.list("GATE_CLEARANCE_RULES", nil),
+		GateClearanceMinutes: l.int("GATE_CLEARANCE_MINUTES", 30),
+
+		// Access control
+		AccessRules:       l.list("ACCESS_RULES", nil),
+		AccessRaiseFactor: l.int("ACCESS_RAISE_FACTOR", 10),
 
 		// Analytics
-		PostgresURL: envStr("POSTGRES_URL", ""),
-		GeoIPDB:     envStr("GEOIP_DB", ""),
+		PostgresURL: l.secret("POSTGRES_URL", ""),
+		GeoIPDB:     l.str("GEOIP_DB", ""),
+		GeoIPASNDB:  l.str("GEOIP_ASN_DB", ""),
+		GeoIPCityDB: l.str("GEOIP_CITY_DB", ""),
+
+		AnalyticsSinks:          l.list("ANALYTICS_SINKS", nil),
+		AnalyticsSQLitePath:     l.str("ANALYTICS_SQLITE_PATH", "data/analytics.db"),
+		AnalyticsFilePath:       l.str("ANALYTICS_FILE_PATH", "data/events.ndjson"),
+		AnalyticsFileMaxMB:      l.int("ANALYTICS_FILE_MAX_MB", 100),
+		AnalyticsFileMaxBackups: l.int("ANALYTICS_FILE_MAX_BACKUPS", 5),
+
+		AnalyticsIPMode:      l.str("ANALYTICS_IP_MODE", "full"),
+		AnalyticsIPSaltHours: l.int("ANALYTICS_IP_SALT_HOURS", 24),
+
+		AnalyticsRetentionDays: l.int("ANALYTICS_RETENTION_DAYS", 0),
+		AnalyticsAutoMigrate:   l.bool("ANALYTICS_AUTO_MIGRATE", true),
 
 		// Dashboard
-		DashboardPort: envInt("DASHBOARD_PORT", 9000),
+		DashboardPort:   l.int("DASHBOARD_PORT", 9000),
+		DashboardSource: l.str("DASHBOARD_SOURCE", "postgres"),
+		AlertRulesFile:  l.str("ALERT_RULES_FILE", ""),
+
+		// Admin API
+		AdminPort:        l.int("ADMIN_PORT", 0),
+		AdminAPIKeysFile: l.str("ADMIN_API_KEYS_FILE", ""),
+		AdminAuditLog:    l.str("ADMIN_AUDIT_LOG", ""),
 
 		// Auth
-		AuthProvider:              envStr("AUTH_PROVIDER", ""),
-		AuthUsername:              envStr("AUTH_USERNAME", ""),
-		AuthPassword:              envStr("AUTH_PASSWORD", ""),
-		AuthIssuer:                envStr("AUTH_ISSUER", ""),
-		AuthClientID:              envStr("AUTH_CLIENT_ID", ""),
-		AuthClientSecret:          envStr("AUTH_CLIENT_SECRET", ""),
-		AuthPKCE:                  envBool("AUTH_PKCE", true),
-		AuthAuthorizationEndpoint: envStr("AUTH_AUTHORIZATION_ENDPOINT", ""),
-		AuthTokenEndpoint:         envStr("AUTH_TOKEN_ENDPOINT", ""),
-		AuthEndSessionEndpoint:    envStr("AUTH_END_SESSION_ENDPOINT", ""),
-		AuthJWKSURI:               envStr("AUTH_JWKS_URI", ""),
-		AuthAllowedUsers:          envList("AUTH_ALLOWED_USERS", nil),
-		AuthAllowedGroups:         envList("AUTH_ALLOWED_GROUPS", nil),
-		AuthAllowedRoles:          envList("AUTH_ALLOWED_ROLES", nil),
+		AuthProvider:              l.str("AUTH_PROVIDER", ""),
+		AuthUsername:              l.str("AUTH_USERNAME", ""),
+		AuthPassword:              l.secret("AUTH_PASSWORD", ""),
+		AuthIssuer:                l.str("AUTH_ISSUER", ""),
+		AuthClientID:              l.str("AUTH_CLIENT_ID", ""),
+		AuthClientSecret:          l.secret("AUTH_CLIENT_SECRET", ""),
+		AuthPKCE:                  l.bool("AUTH_PKCE", true),
+		AuthAuthorizationEndpoint: l.str("AUTH_AUTHORIZATION_ENDPOINT", ""),
+		AuthTokenEndpoint:         l.str("AUTH_TOKEN_ENDPOINT", ""),
+		AuthEndSessionEndpoint:    l.str("AUTH_END_SESSION_ENDPOINT", ""),
+		AuthJWKSURI:               l.str("AUTH_JWKS_URI", ""),
+		AuthAllowedUsers:          l.list("AUTH_ALLOWED_USERS", nil),
+		AuthAllowedGroups:         l.list("AUTH_ALLOWED_GROUPS", nil),
+		AuthAllowedRoles:          l.list("AUTH_ALLOWED_ROLES", nil),
 	}
 
-	if cfg.Secret == "$ecret.key" {
-		fmt.Println(" [WARNING] CHANGE ALTCHA SECRET KEY - its still default !!! ")
+	if cfg.AnalyticsSinks == nil && cfg.PostgresURL != "" {
+		cfg.AnalyticsSinks = []string{"postgres", "live"}
 	}
 
-	return cfg
-}
+	l.unknown()
+	validate(cfg, l)
 
-func envStr(key, fallback string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+	if len(l.errs) > 0 {
+		return nil, errors.Join(l.errs...)
 	}
-	return fallback
+	return cfg, nil
 }
 
-func envInt(key string, fallback int) int {
-	if v := os.Getenv(key); v != "" {
-		if n, err := strconv.Atoi(v); err == nil {
-			return n
+func validate(cfg *Config, l *loader) {
+	l.oneOf("ENVIRONMENT", cfg.Environment, "development", "production")
+	l.oneOf("ALGORITHM", cfg.Algorithm, "SHA-1", "SHA-256", "SHA-512")
+	l.oneOf("STORE", cfg.Store, "memory", "sqlite", "redis")
+	l.oneOf("LOG_LEVEL", strings.ToLower(cfg.LogLevel), "info", "debug")
+	l.oneOf("GATE_ACTION", cfg.GateAction, "deny", "challenge")
+	l.oneOf("AUTH_PROVIDER", cfg.AuthProvider, "", "basic", "keycloak")
+	l.oneOf("DASHBOARD_SOURCE", cfg.DashboardSource, "postgres", "sqlite")
+	l.oneOf("ANALYTICS_IP_MODE", cfg.AnalyticsIPMode, "full", "truncate", "hash", "drop")
+	for _, v := range cfg.TrustedProxies {
+		if _, err := parseNet(v); err != nil {
+			l.errorf("TRUSTED_PROXIES: %q is not an IP or CIDR", v)
 		}
 	}
-	return fallback
-}
-
-func envFloat(key string, fallback float64) float64 {
-	if v := os.Getenv(key); v != "" {
-		if f, err := strconv.ParseFloat(v, 64); err == nil {
-			return f
+	for _, sink := range cfg.AnalyticsSinks {
+		l.oneOf("ANALYTICS_SINKS", sink, "postgres", "sqlite", "file", "stdout", "live")
+		if (sink == "postgres" || sink == "live") && cfg.PostgresURL == "" {
+			l.errorf("ANALYTICS_SINKS: %s requires POSTGRES_URL", sink)
 		}
 	}
-	return fallback
-}
 
-func envBool(key string, fallback bool) bool {
-	if v := os.Getenv(key); v != "" {
-		return strings.EqualFold(v, "true")
+	l.port("PORT", cfg.Port, false)
+	l.port("DEMO_PORT", cfg.DemoPort, false)
+	l.port("INTERNAL_PORT", cfg.InternalPort, true)
+	l.port("GATE_PORT", cfg.GatePort, false)
+	l.port("DASHBOARD_PORT", cfg.DashboardPort, false)
+	l.port("ADMIN_PORT", cfg.AdminPort, true)
+
+	l.min("EXPIREMINUTES", cfg.ExpireMinutes, 1)
+	l.min("COMPLEXITY", cfg.MaxNumber, 1)
+	l.min("MAXRECORDS", cfg.MaxRecords, 1)
+	l.min("GATE_CLEARANCE_MINUTES", cfg.GateClearanceMinutes, 1)
+	l.min("ACCESS_RAISE_FACTOR", cfg.AccessRaiseFactor, 2)
+	l.min("ANALYTICS_FILE_MAX_MB", cfg.AnalyticsFileMaxMB, 1)
+	l.min("ANALYTICS_IP_SALT_HOURS", cfg.AnalyticsIPSaltHours, 1)
+	l.min("ANALYTICS_FILE_MAX_BACKUPS", cfg.AnalyticsFileMaxBackups, 0)
+	if cfg.AnalyticsRetentionDays != 0 {
+		// Queries fill the day after the last daily rollup from raw events.
+		l.min("ANALYTICS_RETENTION_DAYS", cfg.AnalyticsRetentionDays, 2)
+	}
+	if cfg.RateLimit < 0 {
+		l.errorf("RATE_LIMIT: %v must not be negative", cfg.RateLimit)
 	}
-	return fallback
-}
 
-func envList(key string, fallback []string) []string {
-	if v := os.Getenv(key); v != "" {
-		parts := strings.Split(v, ",")
-		for i := range parts {
-			parts[i] = strings.TrimSpace(parts[i])
+	if cfg.InternalEnabled() && cfg.InternalPort == cfg.Port {
+		l.errorf("INTERNAL_PORT: must differ from PORT (%d)", cfg.Port)
+	}
+	if cfg.AdminEnabled() {
+		if cfg.AdminPort == cfg.Port || cfg.AdminPort == cfg.InternalPort {
+			l.errorf("ADMIN_PORT: must differ from PORT and INTERNAL_PORT")
 		}
-		return parts
+		if cfg.AdminAPIKeysFile == "" {
+			l.errorf("ADMIN_API_KEYS_FILE: required when ADMIN_PORT is set")
+		}
+	}
+}
+
+// CheckSecret refuses the default secret in production and warns about it
+// otherwise.
+func (c *Config) CheckSecret() error {
+	if c.Secret != DefaultSecret {
+		return nil
+	}
+	if c.IsProduction() {
+		return errors.New("SECRET must be changed from the default in production")
 	}
-	return fallback
+	fmt.Println(" [WARNING] CHANGE ALTCHA SECRET KEY - its still default !!! ")
+	return nil
 }
@@ -0,0 +1,291 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Holder gives access to the current configuration, which can be replaced at
+// runtime. Consumers call Get for every request instead of keeping a copy.
+type Holder struct {
+	mu  sync.Mutex // serializes reloads and the fields below
+	cur atomic.Pointer[Config]
+
+	overrides map[string]string // set through the admin API, win over env and file
+	previous  string            // secret replaced by RotateSecret
+	until     time.Time
+	base      string // SECRET from env or file when RotateSecret last ran
+}
+
+func NewHolder(cfg *Config) *Holder {
+	h := &Holder{}
+	h.cur.Store(cfg)
+	return h
+}
+
+func (h *Holder) Get() *Config {
+	return h.cur.Load()
+}
+
+// Change describes a setting that differs after a reload.
+type Change struct {
+	Key     string `json:"key"`
+	Old     string `json:"old"`
+	New     string `json:"new"`
+	Restart bool   `json:"restart,omitempty"` // kept at its old value until the process restarts
+	Note    string `json:"note,omitempty"`
+}
+
+func (c Change) String() string {
+	s := fmt.Sprintf("%s: %s -> %s", c.Key, c.Old, c.New)
+	if c.Restart {
+		s += " (restart required)"
+	}
+	if c.Note != "" {
+		s += " (" + c.Note + ")"
+	}
+	return s
+}
+
+// Reload reads the configuration again, including files referenced by _FILE
+// variables, and swaps it in. An invalid configuration is rejected and the
+// current one is kept. Settings tagged "restart" keep their current value.
+//
+// A key from RotateSecret is kept until SECRET (or SECRET_FILE) itself
+// changes; the new value then replaces it.
+func (h *Holder) Reload() ([]Change, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	next, replaced := h.overrides, false
+	if _, ok := next["SECRET"]; ok {
+		without := maps.Clone(next)
+		delete(without, "SECRET")
+		if base, err := load(without); err == nil && base.Secret != h.base {
+			next, replaced = without, true
+		}
+	}
+	changes, err := h.apply(next)
+	if err != nil {
+		return nil, err
+	}
+	if replaced {
+		for i := range changes {
+			if changes[i].Key == "SECRET" {
+				changes[i].Note = "replaces the key from /secret/rotate"
+			}
+		}
+	}
+	h.overrides = next
+	return changes, nil
+}
+
+// Set overrides a setting at runtime. The override survives reloads until it
+// is removed with Unset or the process restarts. Secrets and settings that
+// need a restart cannot be overridden.
+func (h *Holder) Set(key, value string) ([]Change, error) {
+	key = strings.ToUpper(key)
+	f, ok := lookupField(key)
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown setting", key)
+	}
+	if f.secret || f.restart {
+		return nil, fmt.Errorf("%s: cannot be changed at runtime", key)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	next := maps.Clone(h.overrides)
+	if next == nil {
+		next = make(map[string]string)
+	}
+	next[key] = value
+	changes, err := h.apply(next)
+	if err != nil {
+		return nil, err
+	}
+	h.overrides = next
+	return changes, nil
+}
+
+// Unset removes a runtime override, falling back to the environment and the
+// config file.
+func (h *Holder) Unset(key string) ([]Change, error) {
+	key = strings.ToUpper(key)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.overrides[key]; !ok || key == "SECRET" {
+		return nil, fmt.Errorf("%s: not overridden", key)
+	}
+	next := maps.Clone(h.overrides)
+	delete(next, key)
+	changes, err := h.apply(next)
+	if err != nil {
+		return nil, err
+	}
+	h.overrides = next
+	return changes, nil
+}
+
+// Overrides returns the settings changed at runtime, secrets masked.
+func (h *Holder) Overrides() map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	out := make(map[string]string, len(h.overrides))
+	for k, v := range h.overrides {
+		if f, ok := lookupField(k); ok && f.secret {
+			v = "***"
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// RotateSecret replaces SECRET with a random key. Payloads signed with the old
+// key keep verifying for grace; a zero grace invalidates them immediately.
+// The new key lives only in this process, until a reload finds a different
+// SECRET or the process restarts.
+func (h *Holder) RotateSecret(grace time.Duration) error {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	next := maps.Clone(h.overrides)
+	if next == nil {
+		next = make(map[string]string)
+	}
+	next["SECRET"] = hex.EncodeToString(buf)
+
+	without := maps.Clone(next)
+	delete(without, "SECRET")
+	base, err := load(without)
+	if err != nil {
+		return err
+	}
+
+	previous, until := h.previous, h.until
+	h.previous, h.until = h.Get().Secret, time.Now().Add(grace)
+	if _, err := h.apply(next); err != nil {
+		h.previous, h.until = previous, until
+		return err
+	}
+	h.overrides, h.base = next, base.Secret
+	return nil
+}
+
+// apply loads the configuration with overrides and swaps it in. Callers hold
+// h.mu.
+func (h *Holder) apply(overrides map[string]string) ([]Change, error) {
+	fresh, err := load(overrides)
+	if err != nil {
+		return nil, err
+	}
+	if err := fresh.CheckSecret(); err != nil {
+		return nil, err
+	}
+	fresh.PreviousSecret, fresh.PreviousSecretUntil = h.previous, h.until
+
+	cur := reflect.ValueOf(h.Get()).Elem()
+	next := reflect.ValueOf(fresh).Elem()
+	var changes []Change
+	for _, f := range fields() {
+		old, val := cur.Field(f.index), next.Field(f.index)
+		if reflect.DeepEqual(old.Interface(), val.Interface()) {
+			continue
+		}
+		c := Change{Key: f.key, Old: f.format(old), New: f.format(val), Restart: f.restart}
+		if f.restart {
+			val.Set(old)
+		}
+		changes = append(changes, c)
+	}
+	h.cur.Store(fresh)
+	return changes, nil
+}
+
+// Values returns every setting by name, secrets masked.
+func (c *Config) Values() map[string]any {
+	v := reflect.ValueOf(c).Elem()
+	out := make(map[string]any)
+	for _, f := range fields() {
+		val := v.Field(f.index)
+		if f.secret && val.String() != "" {
+			out[f.key] = "***"
+			continue
+		}
+		out[f.key] = val.Interface()
+	}
+	return out
+}
+
+type field struct {
+	index   int
+	key     string
+	secret  bool
+	restart bool
+}
+
+func lookupField(key string) (field, bool) {
+	for _, f := range fields() {
+		if f.key == key {
+			return f, true
+		}
+	}
+	return field{}, false
+}
+
+// fields lists the Config fields that carry an env tag.
+func fields() []field {
+	t := reflect.TypeOf(Config{})
+	var out []field
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("env")
+		if tag == "" {
+			continue
+		}
+		key, opts, _ := strings.Cut(tag, ",")
+		f := field{index: i, key: key}
+		for _, o := range strings.Split(opts, ",") {
+			switch o {
+			case "secret":
+				f.secret = true
+			case "restart":
+				f.restart = true
+			}
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// format renders v for logs, hiding secrets.
+func (f field) format(v reflect.Value) string {
+	if f.secret {
+		if v.String() == "" {
+			return `""`
+		}
+		return "***"
+	}
+	if v.Kind() == reflect.Slice {
+		return fmt.Sprintf("%q", strings.Join(v.Interface().([]string), ","))
+	}
+	if v.Kind() == reflect.String {
+		return fmt.Sprintf("%q", v.String())
+	}
+	return fmt.Sprint(v.Interface())
+}
@@ -0,0 +1,193 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loader resolves settings from runtime overrides first, the environment
+// second and the config file third, recording every key it is asked for so
+// unknown file keys can be reported, and collecting parse errors instead of
+// silently falling back.
+type loader struct {
+	overrides map[string]string
+	file      map[string]string
+	known     map[string]bool
+	errs      []error
+}
+
+func newLoader(path string, overrides map[string]string) (*loader, error) {
+	l := &loader{overrides: overrides, file: make(map[string]string), known: make(map[string]bool)}
+	if path == "" {
+		return l, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	for k, v := range raw {
+		key := strings.ToUpper(k)
+		switch val := v.(type) {
+		case nil:
+			l.file[key] = ""
+		case []interface{}:
+			parts := make([]string, len(val))
+			for i, p := range val {
+				parts[i] = fmt.Sprint(p)
+			}
+			l.file[key] = strings.Join(parts, ",")
+		case map[string]interface{}:
+			l.errorf("%s: nested values are not supported", k)
+		default:
+			l.file[key] = fmt.Sprint(val)
+		}
+	}
+	return l, nil
+}
+
+func (l *loader) errorf(format string, args ...interface{}) {
+	l.errs = append(l.errs, fmt.Errorf(format, args...))
+}
+
+func (l *loader) lookup(key string) (string, bool) {
+	l.known[key] = true
+	if v, ok := l.overrides[key]; ok {
+		return v, v != ""
+	}
+	if v := os.Getenv(key); v != "" {
+		return v, true
+	}
+	if v, ok := l.file[key]; ok && v != "" {
+		return v, true
+	}
+	return "", false
+}
+
+// unknown reports config file keys that no setting asked for.
+func (l *loader) unknown() {
+	var keys []string
+	for k := range l.file {
+		if !l.known[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		l.errorf("%s: unknown setting", strings.ToLower(k))
+	}
+}
+
+func (l *loader) str(key, fallback string) string {
+	if v, ok := l.lookup(key); ok {
+		return v
+	}
+	return fallback
+}
+
+// secret reads a sensitive setting. KEY_FILE, when set, names a file holding
+// the value (Docker and Kubernetes secret mounts) and takes precedence over
+// KEY. Trailing newlines in the file are ignored. A runtime override wins over
+// both.
+func (l *loader) secret(key, fallback string) string {
+	if _, ok := l.overrides[key]; ok {
+		return l.str(key, fallback)
+	}
+	if path, ok := l.lookup(key + "_FILE"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			l.errorf("%s_FILE: %v", key, err)
+			return fallback
+		}
+		return strings.TrimRight(string(data), "\r\n")
+	}
+	return l.str(key, fallback)
+}
+
+func (l *loader) int(key string, fallback int) int {
+	v, ok := l.lookup(key)
+	if !ok {
+		return fallback
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		l.errorf("%s: %q is not an integer", key, v)
+		return fallback
+	}
+	return n
+}
+
+func (l *loader) float(key string, fallback float64) float64 {
+	v, ok := l.lookup(key)
+	if !ok {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil {
+		l.errorf("%s: %q is not a number", key, v)
+		return fallback
+	}
+	return f
+}
+
+func (l *loader) bool(key string, fallback bool) bool {
+	v, ok := l.lookup(key)
+	if !ok {
+		return fallback
+	}
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "true", "1", "yes":
+		return true
+	case "false", "0", "no":
+		return false
+	}
+	l.errorf("%s: %q is not a boolean (true or false)", key, v)
+	return fallback
+}
+
+func (l *loader) list(key string, fallback []string) []string {
+	v, ok := l.lookup(key)
+	if !ok {
+		return fallback
+	}
+	parts := strings.Split(v, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts
+}
+
+func (l *loader) oneOf(key, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	l.errorf("%s: %q must be one of %s", key, value, strings.Join(allowed, ", "))
+}
+
+func (l *loader) min(key string, value, min int) {
+	if value < min {
+		l.errorf("%s: %d must be at least %d", key, value, min)
+	}
+}
+
+func (l *loader) port(key string, value int, optional bool) {
+	if optional && value == 0 {
+		return
+	}
+	if value < 1 || value > 65535 {
+		l.errorf("%s: %d is not a valid port", key, value)
+	}
+}
@@ -1,19 +1,22 @@
 package dashboard
 
 import (
-	"database/sql"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/labstack/echo/v4"
 
 	"altcha/pkg/analytics"
+	"altcha/pkg/config"
 )
 
-func summaryHandler(db *sql.DB) echo.HandlerFunc {
+func summaryHandler(src analytics.Source) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		from, to := parseTimeRange(c)
-		summary, err := analytics.QuerySummary(c.Request().Context(), db, from, to)
+		summary, err := src.Summary(c.Request().Context(), from, to)
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		}
@@ -21,10 +24,27 @@ func summaryHandler(db *sql.DB) echo.HandlerFunc {
 	}
 }
 
-func timeseriesHandler(db *sql.DB) echo.HandlerFunc {
+func timeseriesHandler(src analytics.Source) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		loc, err := parseLocation(c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
 		from, to := parseTimeRange(c)
-		points, err := analytics.QueryTimeseries(c.Request().Context(), db, from, to)
+
+		bucket := c.QueryParam("bucket")
+		if bucket == "" {
+			bucket = "day"
+		}
+		size, ok := analytics.Buckets[bucket]
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "bucket must be minute, hour, day or week"})
+		}
+		if to.Sub(from)/size > analytics.MaxTimeseriesPoints {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "range too long for " + bucket + " buckets"})
+		}
+
+		points, err := src.Timeseries(c.Request().Context(), from, to, bucket, loc)
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		}
@@ -32,10 +52,83 @@ func timeseriesHandler(db *sql.DB) echo.HandlerFunc {
 	}
 }
 
-func locationsHandler(db *sql.DB) echo.HandlerFunc {
+func locationsHandler(src analytics.Source) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		from, to := parseTimeRange(c)
+		entries, err := src.Locations(c.Request().Context(), from, to)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, entries)
+	}
+}
+
+func funnelHandler(h *config.Holder, src analytics.Source) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		from, to := parseTimeRange(c)
+		// Challenges younger than their expiry may still be redeemed.
+		pendingSince := time.Now().Add(-time.Duration(h.Get().ExpireMinutes) * time.Minute)
+		report, err := src.Funnel(c.Request().Context(), from, to, pendingSince)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, report)
+	}
+}
+
+func solveTimesHandler(src analytics.Source) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		from, to := parseTimeRange(c)
+		st, err := src.SolveTimes(c.Request().Context(), from, to)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, st)
+	}
+}
+
+func breakdownHandler(src analytics.Source) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		dimension := c.Param("dimension")
+		if _, ok := analytics.Dimensions[dimension]; !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "unknown dimension " + dimension})
+		}
+		limit, err := intParam(c, "limit", 20, 1, analytics.MaxBreakdownRows)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		from, to := parseTimeRange(c)
+		entries, err := src.Breakdown(c.Request().Context(), dimension, from, to, limit)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, entries)
+	}
+}
+
+func topHandler(src analytics.Source) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		by := c.Param("by")
+		if _, ok := analytics.TopGroups[by]; !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "unknown group " + by})
+		}
+		order := c.QueryParam("sort")
+		if order == "" {
+			order = analytics.TopByVolume
+		}
+		if order != analytics.TopByVolume && order != analytics.TopByFailure {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "sort must be volume or failure"})
+		}
+		limit, err := intParam(c, "limit", 20, 1, analytics.MaxBreakdownRows)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		min, err := intParam(c, "min", 10, 1, 1000000)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
 		from, to := parseTimeRange(c)
-		entries, err := analytics.QueryLocations(c.Request().Context(), db, from, to)
+		entries, err := src.Top(c.Request().Context(), by, order, from, to, limit, min)
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		}
@@ -43,18 +136,137 @@ func locationsHandler(db *sql.DB) echo.HandlerFunc {
 	}
 }
 
+// anomaliesHandler compares the last window with the windows before it,
+// regardless of the selected range.
+func anomaliesHandler(src analytics.Source) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		opts := analytics.AnomalyOptions{Window: time.Hour, Threshold: 3}
+		if v := c.QueryParam("window"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 5*time.Minute || d > 24*time.Hour {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "window must be a duration between 5m and 24h"})
+			}
+			opts.Window = d
+		}
+		baseline, err := intParam(c, "baseline", 24, 2, 168)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		min, err := intParam(c, "min", 20, 1, 1000000)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		if v := c.QueryParam("threshold"); v != "" {
+			z, err := strconv.ParseFloat(v, 64)
+			if err != nil || z <= 0 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "threshold must be a positive number"})
+			}
+			opts.Threshold = z
+		}
+		opts.Baseline, opts.MinCount = baseline, int64(min)
+
+		report, err := src.Anomalies(c.Request().Context(), time.Now().UTC(), opts)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, report)
+	}
+}
+
+// liveKeepAlive is the interval of the comments that keep idle event streams
+// open through proxies.
+const liveKeepAlive = 15 * time.Second
+
+// liveHandler streams the live buckets as server-sent events, one JSON
+// bucket per "data" line.
+func liveHandler(live *analytics.LiveFeed) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		buckets, unsubscribe := live.Subscribe()
+		defer unsubscribe()
+
+		w := c.Response()
+		w.Header().Set(echo.HeaderContentType, "text/event-stream")
+		w.Header().Set(echo.HeaderCacheControl, "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "retry: 3000\n\n")
+		w.Flush()
+
+		keepAlive := time.NewTicker(liveKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case b := <-buckets:
+				data, err := json.Marshal(b)
+				if err != nil {
+					return err
+				}
+				if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+					return nil
+				}
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return nil
+				}
+			case <-c.Request().Context().Done():
+				return nil
+			}
+			w.Flush()
+		}
+	}
+}
+
+// intParam reads the integer query parameter name, def when absent.
+func intParam(c echo.Context, name string, def, min, max int) (int, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("%s must be between %d and %d", name, min, max)
+	}
+	return n, nil
+}
+
+// parseLocation returns the IANA time zone of the tz query parameter, UTC when
+// absent.
+func parseLocation(c echo.Context) (*time.Location, error) {
+	tz := c.QueryParam("tz")
+	if tz == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil || tz == "Local" {
+		return nil, fmt.Errorf("unknown time zone %q", tz)
+	}
+	return loc, nil
+}
+
+// parseTimeRange reads from and to as dates in the tz time zone (to is
+// inclusive) or as RFC 3339 timestamps (to is exclusive). The default is the
+// last 7 days.
 func parseTimeRange(c echo.Context) (time.Time, time.Time) {
+	loc, err := parseLocation(c)
+	if err != nil {
+		loc = time.UTC
+	}
+
 	now := time.Now().UTC()
 	to := now
 	from := now.AddDate(0, 0, -7)
 
 	if v := c.QueryParam("from"); v != "" {
-		if t, err := time.Parse("2006-01-02", v); err == nil {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			from = t
+		} else if t, err := time.ParseInLocation("2006-01-02", v, loc); err == nil {
 			from = t
 		}
 	}
 	if v := c.QueryParam("to"); v != "" {
-		if t, err := time.Parse("2006-01-02", v); err == nil {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			to = t
+		} else if t, err := time.ParseInLocation("2006-01-02", v, loc); err == nil {
 			to = t.AddDate(0, 0, 1) // end of day
 		}
 	}
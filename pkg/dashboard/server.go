@@ -1,16 +1,20 @@
 package dashboard
 
 import (
-	"database/sql"
-
 	"github.com/labstack/echo/v4"
 	echomw "github.com/labstack/echo/v4/middleware"
 
+	"altcha/pkg/analytics"
+	"altcha/pkg/assets"
 	"altcha/pkg/auth"
 	"altcha/pkg/config"
+	"altcha/pkg/health"
 )
 
-func NewServer(cfg *config.Config, db *sql.DB) (*echo.Echo, error) {
+// NewServer serves the dashboard over src. live feeds /api/live and may be
+// nil.
+func NewServer(h *config.Holder, src analytics.Source, live *analytics.LiveFeed) (*echo.Echo, error) {
+	cfg := h.Get()
 	e := echo.New()
 	e.HideBanner = true
 
@@ -18,15 +22,31 @@ func NewServer(cfg *config.Config, db *sql.DB) (*echo.Echo, error) {
 		Format: "[DASHBOARD] ${time_rfc3339} ${remote_ip} ${method} ${uri} ${status} ${latency_human}\n",
 	}))
 
-	provider := auth.NewProvider(cfg)
+	checker := health.NewChecker()
+	checker.Add("analytics", true, src.Ping)
+	if cfg.AuthProvider == "keycloak" {
+		checker.Add("oidc", true, health.OIDC(h))
+	}
+
+	provider := auth.NewProvider(h)
 	provider.RegisterRoutes(e)
 
-	api := e.Group("/api", provider.Middleware())
-	api.GET("/summary", summaryHandler(db))
-	api.GET("/timeseries", timeseriesHandler(db))
-	api.GET("/locations", locationsHandler(db))
+	e.GET("/health/deep", checker.Handler(), provider.Middleware())
 
-	e.Static("/", "web/dashboard")
+	api := e.Group("/api", provider.Middleware())
+	api.GET("/summary", summaryHandler(src))
+	api.GET("/timeseries", timeseriesHandler(src))
+	api.GET("/locations", locationsHandler(src))
+	api.GET("/funnel", funnelHandler(h, src))
+	api.GET("/solve-times", solveTimesHandler(src))
+	api.GET("/breakdown/:dimension", breakdownHandler(src))
+	api.GET("/top/:by", topHandler(src))
+	api.GET("/anomalies", anomaliesHandler(src))
+	if live != nil {
+		api.GET("/live", liveHandler(live))
+	}
+
+	e.GET("/*", assets.New(cfg.WebDir).Handler("dashboard"))
 
 	return e, nil
 }
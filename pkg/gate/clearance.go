@@ -0,0 +1,98 @@
+package gate
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"altcha/pkg/handler"
+)
+
+const ClearanceCookie = "altcha_clearance"
+
+// Clearance verifies the payload posted by the interstitial page, sets a
+// signed clearance cookie bound to the client IP and User-Agent, and
+// redirects back to the originally requested URI.
+func (g *Gate) Clearance() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := g.config.Get()
+		res, err := handler.VerifyPayload(cfg, g.store, c.FormValue(cfg.GateField))
+		if err != nil {
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if !res.Verified {
+			return c.NoContent(http.StatusForbidden)
+		}
+
+		ttl := time.Duration(cfg.GateClearanceMinutes) * time.Minute
+		expires := time.Now().Add(ttl).Unix()
+		req := c.Request()
+
+		c.SetCookie(&http.Cookie{
+			Name:     ClearanceCookie,
+			Value:    g.signClearance(expires, g.clientIP(req), req.UserAgent()),
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https",
+			SameSite: http.SameSiteLaxMode,
+			MaxAge:   int(ttl.Seconds()),
+		})
+
+		return c.Redirect(http.StatusSeeOther, safeRedirect(c.FormValue("redirect")))
+	}
+}
+
+func (g *Gate) hasClearance(c echo.Context) bool {
+	ck, err := c.Request().Cookie(ClearanceCookie)
+	if err != nil {
+		return false
+	}
+
+	exp, sig, ok := strings.Cut(ck.Value, ".")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	want := g.signClearance(expires, g.clientIP(c.Request()), c.Request().UserAgent())
+	_, wantSig, _ := strings.Cut(want, ".")
+	return hmac.Equal([]byte(sig), []byte(wantSig))
+}
+
+func (g *Gate) signClearance(expires int64, ip, userAgent string) string {
+	exp := strconv.FormatInt(expires, 10)
+	mac := hmac.New(sha256.New, []byte(g.config.Get().Secret))
+	mac.Write([]byte("clearance\n" + exp + "\n" + ip + "\n" + userAgent))
+	return exp + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// stripClearance removes the clearance cookie so it is not leaked upstream.
+func stripClearance(req *http.Request) {
+	if _, err := req.Cookie(ClearanceCookie); err != nil {
+		return
+	}
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, ck := range cookies {
+		if ck.Name != ClearanceCookie {
+			req.AddCookie(ck)
+		}
+	}
+}
+
+// safeRedirect only allows local absolute paths to avoid an open redirect.
+func safeRedirect(uri string) string {
+	if !strings.HasPrefix(uri, "/") || strings.HasPrefix(uri, "//") || strings.HasPrefix(uri, "/\\") {
+		return "/"
+	}
+	return uri
+}
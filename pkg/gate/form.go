@@ -0,0 +1,156 @@
+package gate
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const maxBodyBytes = 10 << 20
+
+type field struct {
+	Name  string
+	Value string
+}
+
+// submission is the altcha payload extracted from a request together with the
+// remaining form fields, which the interstitial page re-submits.
+type submission struct {
+	Payload string
+	Fields  []field
+}
+
+// extract takes the altcha payload from the configured header, query
+// parameter or form field and strips it from the request before it is
+// forwarded upstream.
+func extract(w http.ResponseWriter, req *http.Request, header, name string) (*submission, error) {
+	sub := &submission{}
+
+	if v := req.Header.Get(header); v != "" {
+		sub.Payload = v
+		req.Header.Del(header)
+	}
+
+	if q := req.URL.Query(); q.Has(name) {
+		if sub.Payload == "" {
+			sub.Payload = q.Get(name)
+		}
+		q.Del(name)
+		req.URL.RawQuery = q.Encode()
+	}
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return sub, nil
+	}
+
+	ct, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch ct {
+	case "application/x-www-form-urlencoded":
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBodyBytes))
+		if err != nil {
+			return nil, err
+		}
+		body = stripURLEncoded(body, name, sub)
+		setBody(req, body)
+	case "multipart/form-data":
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBodyBytes))
+		if err != nil {
+			return nil, err
+		}
+		body, err = stripMultipart(body, params["boundary"], name, sub)
+		if err != nil {
+			return nil, err
+		}
+		setBody(req, body)
+	}
+	return sub, nil
+}
+
+// stripURLEncoded removes the field from an urlencoded body while keeping the
+// remaining pairs byte for byte in their original order.
+func stripURLEncoded(body []byte, name string, sub *submission) []byte {
+	pairs := strings.Split(string(body), "&")
+	kept := pairs[:0]
+	for _, pair := range pairs {
+		if pair == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(pair, "=")
+		key, err := url.QueryUnescape(k)
+		if err != nil {
+			kept = append(kept, pair)
+			continue
+		}
+		value, _ := url.QueryUnescape(v)
+		if key == name {
+			if sub.Payload == "" {
+				sub.Payload = value
+			}
+			continue
+		}
+		sub.Fields = append(sub.Fields, field{Name: key, Value: value})
+		kept = append(kept, pair)
+	}
+	return []byte(strings.Join(kept, "&"))
+}
+
+func stripMultipart(body []byte, boundary, name string, sub *submission) ([]byte, error) {
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+
+	var out bytes.Buffer
+	mw := multipart.NewWriter(&out)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if p.FormName() == name && p.FileName() == "" {
+			v, err := io.ReadAll(p)
+			if err != nil {
+				return nil, err
+			}
+			if sub.Payload == "" {
+				sub.Payload = string(v)
+			}
+			continue
+		}
+
+		pw, err := mw.CreatePart(p.Header)
+		if err != nil {
+			return nil, err
+		}
+		if p.FileName() == "" {
+			var v bytes.Buffer
+			if _, err := io.Copy(pw, io.TeeReader(p, &v)); err != nil {
+				return nil, err
+			}
+			sub.Fields = append(sub.Fields, field{Name: p.FormName(), Value: v.String()})
+		} else if _, err := io.Copy(pw, p); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func setBody(req *http.Request, body []byte) {
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
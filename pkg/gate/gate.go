@@ -0,0 +1,200 @@
+package gate
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+
+	"altcha/pkg/assets"
+	"altcha/pkg/config"
+	"altcha/pkg/handler"
+	"altcha/pkg/middleware"
+	"altcha/pkg/store"
+)
+
+const (
+	ActionDeny      = "deny"
+	ActionChallenge = "challenge"
+
+	// PathPrefix is reserved by the gate for its own challenge endpoint and
+	// widget script; requests under it are never forwarded upstream.
+	PathPrefix = "/.altcha"
+)
+
+// Gate is a reverse proxy that requires a valid altcha payload for requests
+// matching its rules before forwarding them to the upstream.
+type Gate struct {
+	config         *config.Holder
+	store          store.Store
+	rules          []Rule
+	clearanceRules []Rule
+	proxy          *httputil.ReverseProxy
+	page           *template.Template
+	// clientIP is the IP clearance cookies are bound to, read from
+	// X-Forwarded-For only for TRUSTED_PROXIES.
+	clientIP echo.IPExtractor
+}
+
+func New(h *config.Holder, s store.Store) (*Gate, error) {
+	cfg := h.Get()
+
+	upstream, err := url.Parse(cfg.GateUpstream)
+	if err != nil || upstream.Scheme == "" || upstream.Host == "" {
+		return nil, fmt.Errorf("invalid GATE_UPSTREAM %q", cfg.GateUpstream)
+	}
+
+	rules, err := ParseRules(cfg.GateRules)
+	if err != nil {
+		return nil, err
+	}
+	clearanceRules, err := ParseRules(cfg.GateClearanceRules)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 && len(clearanceRules) == 0 {
+		return nil, errors.New("GATE_RULES and GATE_CLEARANCE_RULES are both empty")
+	}
+
+	switch cfg.GateAction {
+	case ActionDeny, ActionChallenge:
+	default:
+		return nil, fmt.Errorf("invalid GATE_ACTION %q (deny or challenge)", cfg.GateAction)
+	}
+
+	page, err := template.ParseFS(assets.New(cfg.WebDir).FS(), "gate/challenge.html")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Gate{
+		config:         h,
+		store:          s,
+		rules:          rules,
+		clearanceRules: clearanceRules,
+		proxy:          httputil.NewSingleHostReverseProxy(upstream),
+		page:           page,
+		clientIP:       middleware.IPExtractor(cfg),
+	}, nil
+}
+
+func (g *Gate) Handler() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := g.config.Get()
+		req := c.Request()
+
+		// never trust a verification header sent by the client
+		req.Header.Del("X-Altcha-Verified")
+
+		// match and forward the same path, so the upstream can't resolve a
+		// path the rules didn't see
+		if p := cleanPath(req.URL.Path); p != req.URL.Path {
+			req.URL.Path, req.URL.RawPath = p, ""
+		}
+
+		if !match(g.rules, req) {
+			if match(g.clearanceRules, req) && !g.hasClearance(c) {
+				return g.interstitial(c)
+			}
+			stripClearance(req)
+			g.proxy.ServeHTTP(c.Response(), req)
+			return nil
+		}
+
+		sub, err := extract(c.Response(), req, cfg.GateHeader, cfg.GateField)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return c.NoContent(http.StatusRequestEntityTooLarge)
+			}
+			return c.NoContent(http.StatusBadRequest)
+		}
+
+		res, err := handler.VerifyPayload(cfg, g.store, sub.Payload)
+		if err != nil {
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if !res.Verified {
+			return g.reject(c, sub)
+		}
+
+		req.Header.Set("X-Altcha-Verified", "true")
+		stripClearance(req)
+		g.proxy.ServeHTTP(c.Response(), req)
+		return nil
+	}
+}
+
+func match(rules []Rule, req *http.Request) bool {
+	for _, r := range rules {
+		if r.Match(req) {
+			return true
+		}
+	}
+	return false
+}
+
+type pageData struct {
+	Method       string
+	Action       string
+	Field        string
+	Fields       []field
+	ChallengeURL string
+	ScriptURL    string
+}
+
+func (g *Gate) reject(c echo.Context, sub *submission) error {
+	cfg := g.config.Get()
+	if cfg.GateAction != ActionChallenge {
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	req := c.Request()
+	data := pageData{
+		Method:       http.MethodPost,
+		Action:       req.URL.RequestURI(),
+		Field:        cfg.GateField,
+		Fields:       sub.Fields,
+		ChallengeURL: PathPrefix + "/challenge",
+		ScriptURL:    PathPrefix + "/altcha.min.js",
+	}
+
+	// a GET form replaces the query string of its action, so the original
+	// query parameters are carried as fields instead
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		data.Method = http.MethodGet
+		data.Action = req.URL.Path
+		data.Fields = nil
+		for k, vs := range req.URL.Query() {
+			for _, v := range vs {
+				data.Fields = append(data.Fields, field{Name: k, Value: v})
+			}
+		}
+	}
+
+	return g.render(c, data)
+}
+
+// interstitial serves the browser check page; once solved, the page posts to
+// the clearance endpoint which sets the cookie and redirects back.
+func (g *Gate) interstitial(c echo.Context) error {
+	return g.render(c, pageData{
+		Method:       http.MethodPost,
+		Action:       PathPrefix + "/clearance",
+		Field:        g.config.Get().GateField,
+		Fields:       []field{{Name: "redirect", Value: c.Request().URL.RequestURI()}},
+		ChallengeURL: PathPrefix + "/challenge",
+		ScriptURL:    PathPrefix + "/altcha.min.js",
+	})
+}
+
+func (g *Gate) render(c echo.Context, data pageData) error {
+	c.Response().Header().Set("Content-Type", "text/html; charset=utf-8")
+	c.Response().Header().Set("Cache-Control", "no-store")
+	c.Response().WriteHeader(http.StatusForbidden)
+	return g.page.Execute(c.Response(), data)
+}
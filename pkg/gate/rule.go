@@ -0,0 +1,79 @@
+package gate
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Rule matches requests that must carry a valid altcha payload.
+// Rules are written as "METHOD /path" or "/path"; a trailing "*" turns the
+// path into a prefix match. Paths match with or without a trailing slash.
+type Rule struct {
+	Method string
+	Path   string
+	Prefix bool
+}
+
+func ParseRules(specs []string) ([]Rule, error) {
+	var rules []Rule
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		var r Rule
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			r.Path = fields[0]
+		case 2:
+			r.Method = strings.ToUpper(fields[0])
+			r.Path = fields[1]
+		default:
+			return nil, fmt.Errorf("invalid gate rule %q", spec)
+		}
+		if r.Method == "*" || r.Method == "ANY" {
+			r.Method = ""
+		}
+		if !strings.HasPrefix(r.Path, "/") {
+			return nil, fmt.Errorf("invalid gate rule %q: path must start with /", spec)
+		}
+		if strings.HasSuffix(r.Path, "*") {
+			r.Path = strings.TrimSuffix(r.Path, "*")
+			r.Prefix = true
+		}
+		r.Path = cleanPath(r.Path)
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// Match expects req.URL.Path to be cleaned with cleanPath, as the gate
+// handler does, so "//login" or "/a/../login" can't slip past "/login".
+func (r Rule) Match(req *http.Request) bool {
+	if r.Method != "" && r.Method != req.Method {
+		return false
+	}
+	if r.Prefix {
+		// "/admin/*" covers "/admin" as well
+		return strings.HasPrefix(req.URL.Path, r.Path) || req.URL.Path == trimSlash(r.Path)
+	}
+	return trimSlash(req.URL.Path) == trimSlash(r.Path)
+}
+
+// cleanPath resolves ".", ".." and repeated slashes like path.Clean, keeping
+// a trailing slash.
+func cleanPath(p string) string {
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+func trimSlash(p string) string {
+	if len(p) > 1 {
+		return strings.TrimSuffix(p, "/")
+	}
+	return p
+}
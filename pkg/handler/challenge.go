@@ -1,6 +1,8 @@
 package handler
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
 	"time"
 
@@ -10,19 +12,55 @@ import (
 	"altcha/pkg/config"
 )
 
-func Challenge(cfg *config.Config) echo.HandlerFunc {
+// NewChallenge creates a challenge signed with the configured secret.
+func NewChallenge(cfg *config.Config, algorithm string, maxNumber int) (altcha.Challenge, error) {
+	expires := time.Now().Add(time.Duration(cfg.ExpireMinutes) * time.Minute)
+
+	return altcha.CreateChallenge(altcha.ChallengeOptions{
+		Algorithm: altcha.Algorithm(algorithm),
+		HMACKey:   cfg.Secret,
+		MaxNumber: int64(maxNumber),
+		Expires:   &expires,
+	})
+}
+
+// ContextComplexityFactor is the echo context key for an int multiplier applied
+// to COMPLEXITY, set by the access layer for suspicious clients.
+const ContextComplexityFactor = "complexity_factor"
+
+// ContextChallengeID is the echo context key for the id of the challenge issued
+// or redeemed by a request, recorded by analytics to link the two.
+const ContextChallengeID = "challenge_id"
+
+// Echo context keys for the algorithm (string) and complexity (int, the
+// maxnumber) of the challenge issued or redeemed by a request, recorded by
+// analytics.
+const (
+	ContextAlgorithm  = "algorithm"
+	ContextComplexity = "complexity"
+)
+
+// ChallengeID identifies a challenge by a hash of its salt, which is unique per
+// challenge and comes back unchanged in the payload.
+func ChallengeID(salt string) string {
+	sum := sha256.Sum256([]byte(salt))
+	return hex.EncodeToString(sum[:16])
+}
+
+func Challenge(h *config.Holder) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		expires := time.Now().Add(time.Duration(cfg.ExpireMinutes) * time.Minute)
-
-		challenge, err := altcha.CreateChallenge(altcha.ChallengeOptions{
-			Algorithm: altcha.Algorithm(cfg.Algorithm),
-			HMACKey:   cfg.Secret,
-			MaxNumber: int64(cfg.MaxNumber),
-			Expires:   &expires,
-		})
+		cfg := h.Get()
+		maxNumber := cfg.MaxNumber
+		if f, ok := c.Get(ContextComplexityFactor).(int); ok && f > 1 {
+			maxNumber *= f
+		}
+		challenge, err := NewChallenge(cfg, cfg.Algorithm, maxNumber)
 		if err != nil {
 			return c.NoContent(http.StatusInternalServerError)
 		}
+		c.Set(ContextChallengeID, ChallengeID(challenge.Salt))
+		c.Set(ContextAlgorithm, cfg.Algorithm)
+		c.Set(ContextComplexity, maxNumber)
 
 		return c.JSON(http.StatusOK, challenge)
 	}
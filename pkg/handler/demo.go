@@ -1,51 +1,73 @@
 package handler
 
 import (
-	"fmt"
-	"io"
 	"net/http"
+	"strconv"
 
 	"github.com/labstack/echo/v4"
 
+	"altcha/pkg/assets"
 	"altcha/pkg/config"
+	"altcha/pkg/store"
 )
 
-func DemoPage() echo.HandlerFunc {
-	return func(c echo.Context) error {
-		return c.File("web/demo/index.html")
-	}
+// demoMaxComplexity caps the complexity a tester can pick on the demo page.
+const demoMaxComplexity = 10000000
+
+type demoResult struct {
+	VerifyResult
+	Status int `json:"status"`
 }
 
-func DemoChallenge(cfg *config.Config) echo.HandlerFunc {
+func DemoPage(a *assets.Assets) echo.HandlerFunc {
+	return a.File("demo/index.html")
+}
+
+// DemoChallenge issues a challenge in-process. The algorithm and complexity
+// default to the server configuration and may be overridden by the tester.
+func DemoChallenge(h *config.Holder) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		url := fmt.Sprintf("http://localhost:%d/challenge", cfg.Port)
+		cfg := h.Get()
+		algorithm := cfg.Algorithm
+		if v := c.QueryParam("algorithm"); v != "" {
+			switch v {
+			case "SHA-1", "SHA-256", "SHA-512":
+				algorithm = v
+			default:
+				return c.NoContent(http.StatusBadRequest)
+			}
+		}
 
-		resp, err := http.Get(url)
-		if err != nil {
-			return c.NoContent(http.StatusBadGateway)
+		complexity := cfg.MaxNumber
+		if v := c.QueryParam("complexity"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > demoMaxComplexity {
+				return c.NoContent(http.StatusBadRequest)
+			}
+			complexity = n
 		}
-		defer resp.Body.Close()
 
-		body, err := io.ReadAll(resp.Body)
+		challenge, err := NewChallenge(cfg, algorithm, complexity)
 		if err != nil {
 			return c.NoContent(http.StatusInternalServerError)
 		}
-
-		return c.JSONBlob(resp.StatusCode, body)
+		return c.JSON(http.StatusOK, challenge)
 	}
 }
 
-func DemoTest(cfg *config.Config) echo.HandlerFunc {
+// DemoTest verifies the submitted payload in-process through the same logic
+// as /verify and reports the full result.
+func DemoTest(h *config.Holder, s store.Store) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		payload := c.FormValue("altcha")
-		url := fmt.Sprintf("http://localhost:%d/verify?altcha=%s", cfg.Port, payload)
-
-		resp, err := http.Get(url)
+		res, err := VerifyPayload(h.Get(), s, c.FormValue("altcha"))
 		if err != nil {
-			return c.NoContent(http.StatusBadGateway)
+			return c.NoContent(http.StatusInternalServerError)
 		}
-		defer resp.Body.Close()
 
-		return c.NoContent(resp.StatusCode)
+		status := http.StatusExpectationFailed
+		if res.Verified {
+			status = http.StatusAccepted
+		}
+		return c.JSON(http.StatusOK, demoResult{VerifyResult: res, Status: status})
 	}
 }
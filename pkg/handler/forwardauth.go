@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+
+	"altcha/pkg/config"
+	"altcha/pkg/store"
+)
+
+// ForwardAuth verifies the altcha payload of a request forwarded by a reverse
+// proxy (nginx auth_request, Traefik ForwardAuth). The payload is looked up in
+// the configured header, cookie, form field, or the query string of the
+// original URI, in that order.
+func ForwardAuth(h *config.Holder, s store.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := h.Get()
+		res, err := VerifyPayload(cfg, s, forwardedPayload(c, cfg))
+		if err != nil {
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		setVerifyContext(c, res)
+
+		h := c.Response().Header()
+		h.Set("X-Altcha-Reason", res.Reason)
+		if res.Verified {
+			h.Set("X-Altcha-Verified", "true")
+			return c.NoContent(http.StatusOK)
+		}
+
+		h.Set("X-Altcha-Verified", "false")
+		if res.Reason == ReasonMissing {
+			return c.NoContent(http.StatusUnauthorized)
+		}
+		return c.NoContent(http.StatusForbidden)
+	}
+}
+
+func forwardedPayload(c echo.Context, cfg *config.Config) string {
+	req := c.Request()
+
+	if v := req.Header.Get(cfg.ForwardAuthHeader); v != "" {
+		return v
+	}
+	if ck, err := req.Cookie(cfg.ForwardAuthCookie); err == nil && ck.Value != "" {
+		// PathUnescape keeps the "+" of base64 payloads set without encoding.
+		if v, err := url.PathUnescape(ck.Value); err == nil {
+			return v
+		}
+		return ck.Value
+	}
+	if v := c.FormValue(cfg.ForwardAuthField); v != "" {
+		return v
+	}
+
+	// nginx passes the original URI as X-Original-URI, Traefik as X-Forwarded-Uri
+	for _, name := range []string{"X-Original-URI", "X-Forwarded-Uri"} {
+		if raw := req.Header.Get(name); raw != "" {
+			if u, err := url.ParseRequestURI(raw); err == nil {
+				if v := u.Query().Get(cfg.ForwardAuthField); v != "" {
+					return v
+				}
+			}
+		}
+	}
+	return ""
+}
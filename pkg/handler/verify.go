@@ -1,7 +1,11 @@
 package handler
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"net/http"
+	"strconv"
+	"time"
 
 	altcha "github.com/altcha-org/altcha-lib-go"
 	"github.com/labstack/echo/v4"
@@ -10,26 +14,117 @@ import (
 	"altcha/pkg/store"
 )
 
-func Verify(cfg *config.Config, s store.Store) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		payload := c.QueryParam("altcha")
+const (
+	ReasonOK      = "ok"
+	ReasonMissing = "missing"
+	ReasonReplay  = "replay"
+	ReasonExpired = "expired"
+	ReasonInvalid = "invalid"
+)
 
-		exists, err := s.Exists(payload)
-		if err != nil {
-			return c.NoContent(http.StatusInternalServerError)
-		}
-		if exists {
-			return c.NoContent(http.StatusExpectationFailed)
+// ContextVerifyReason is the echo context key for the Reason of a
+// verification, recorded by analytics.
+const ContextVerifyReason = "verify_reason"
+
+type VerifyResult struct {
+	Verified  bool       `json:"verified"`
+	Reason    string     `json:"reason"`
+	Algorithm string     `json:"algorithm,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	// ChallengeID of the decoded payload (see ChallengeID).
+	ChallengeID string `json:"-"`
+}
+
+// VerifyPayload checks an altcha payload and marks it as used so it cannot be
+// replayed. An error is returned only when the store fails.
+func VerifyPayload(cfg *config.Config, s store.Store, payload string) (VerifyResult, error) {
+	if payload == "" {
+		return VerifyResult{Reason: ReasonMissing}, nil
+	}
+
+	decoded, err := DecodePayload(payload)
+	if err != nil {
+		return VerifyResult{Reason: ReasonInvalid}, nil
+	}
+
+	res := VerifyResult{Algorithm: decoded.Algorithm}
+	if decoded.Salt != "" {
+		res.ChallengeID = ChallengeID(decoded.Salt)
+	}
+	if v := altcha.ExtractParams(decoded).Get("expires"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			t := time.Unix(n, 0).UTC()
+			res.Expires = &t
 		}
+	}
+
+	exists, err := s.Exists(payload)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+	if exists {
+		res.Reason = ReasonReplay
+		return res, nil
+	}
+
+	if res.Expires != nil && time.Now().After(*res.Expires) {
+		res.Reason = ReasonExpired
+		return res, nil
+	}
 
-		ok, err := altcha.VerifySolution(payload, cfg.Secret, true)
+	var ok bool
+	for _, secret := range cfg.Secrets() {
+		ok, err = altcha.VerifySolution(decoded, secret, true)
 		if err != nil {
-			return c.NoContent(http.StatusExpectationFailed)
+			res.Reason = ReasonInvalid
+			return res, nil
 		}
+		if ok {
+			break
+		}
+	}
 
-		_ = s.Add(payload)
+	_ = s.Add(payload)
 
-		if ok {
+	if ok {
+		res.Verified = true
+		res.Reason = ReasonOK
+	} else {
+		res.Reason = ReasonInvalid
+	}
+	return res, nil
+}
+
+// DecodePayload parses the base64 JSON payload submitted by the widget.
+func DecodePayload(payload string) (altcha.Payload, error) {
+	var p altcha.Payload
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return p, err
+	}
+	err = json.Unmarshal(data, &p)
+	return p, err
+}
+
+// setVerifyContext stores the outcome of a verification for analytics.
+func setVerifyContext(c echo.Context, res VerifyResult) {
+	c.Set(ContextVerifyReason, res.Reason)
+	if res.ChallengeID != "" {
+		c.Set(ContextChallengeID, res.ChallengeID)
+	}
+	if res.Algorithm != "" {
+		c.Set(ContextAlgorithm, res.Algorithm)
+	}
+}
+
+func Verify(h *config.Holder, s store.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		res, err := VerifyPayload(h.Get(), s, c.QueryParam("altcha"))
+		if err != nil {
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		setVerifyContext(c, res)
+		if res.Verified {
 			return c.NoContent(http.StatusAccepted)
 		}
 		return c.NoContent(http.StatusExpectationFailed)
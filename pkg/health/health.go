@@ -0,0 +1,268 @@
+// Package health runs the component checks behind /health/deep.
+package health
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"altcha/pkg/analytics"
+	"altcha/pkg/config"
+	"altcha/pkg/handler"
+	"altcha/pkg/solver"
+	"altcha/pkg/store"
+)
+
+const (
+	StatusOK          = "ok"
+	StatusDegraded    = "degraded"
+	StatusUnavailable = "unavailable"
+	StatusFail        = "fail"
+)
+
+// Timeout bounds a whole /health/deep run. Checks still running are reported
+// as failed.
+const Timeout = 5 * time.Second
+
+// syntheticMaxNumber keeps the synthetic challenge cheap to solve.
+const syntheticMaxNumber = 1000
+
+// CacheTTL is how long Handler serves the last report, so frequent probes
+// don't each run every check.
+const CacheTTL = 5 * time.Second
+
+type check struct {
+	name     string
+	critical bool
+	run      func(ctx context.Context) error
+}
+
+type Result struct {
+	Status    string  `json:"status"`
+	Critical  bool    `json:"critical"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status  string            `json:"status"`
+	Version string            `json:"version"`
+	Go      string            `json:"go"`
+	Checks  map[string]Result `json:"checks"`
+}
+
+// Checker runs its checks concurrently. A failed critical check makes the
+// report unavailable; a failed optional one only degrades it.
+type Checker struct {
+	checks []check
+
+	mu   sync.Mutex // held while a run for Handler is in progress
+	last Report
+	at   time.Time
+}
+
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+func (c *Checker) Add(name string, critical bool, run func(ctx context.Context) error) {
+	c.checks = append(c.checks, check{name: name, critical: critical, run: run})
+}
+
+func (c *Checker) Run(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	report := Report{
+		Status:  StatusOK,
+		Version: handler.Version,
+		Go:      runtime.Version(),
+		Checks:  make(map[string]Result, len(c.checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, chk := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := runCheck(ctx, chk)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[chk.name] = res
+			if res.Status == StatusOK {
+				return
+			}
+			if chk.critical {
+				report.Status = StatusUnavailable
+			} else if report.Status == StatusOK {
+				report.Status = StatusDegraded
+			}
+		}()
+	}
+	wg.Wait()
+	return report
+}
+
+// runCheck returns when the check finishes or ctx is done, whichever comes
+// first, so a hung dependency cannot block the report.
+func runCheck(ctx context.Context, chk check) Result {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- chk.run(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = errors.New("timed out")
+	}
+
+	res := Result{
+		Status:    StatusOK,
+		Critical:  chk.critical,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		res.Status = StatusFail
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// cached returns the last report while it is younger than CacheTTL, and
+// runs the checks otherwise. Concurrent callers share one run.
+func (c *Checker) cached(ctx context.Context) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.at) < CacheTTL {
+		return c.last
+	}
+	c.last, c.at = c.Run(ctx), time.Now()
+	return c.last
+}
+
+// Handler answers 200 when every critical check passed and 503 otherwise.
+func (c *Checker) Handler() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		report := c.cached(ctx.Request().Context())
+		status := http.StatusOK
+		if report.Status == StatusUnavailable {
+			status = http.StatusServiceUnavailable
+		}
+		return ctx.JSON(status, report)
+	}
+}
+
+// Store pings the token store, then adds a synthetic health:<random> token
+// and reads it back, catching a store that answers pings but fails writes.
+// In a store bounded by MAXRECORDS each run takes one record.
+func Store(s store.Store) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if err := s.Ping(); err != nil {
+			return err
+		}
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		token := "health:" + hex.EncodeToString(b)
+		if err := s.Add(token); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+		ok, err := s.Exists(token)
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+		if !ok {
+			return errors.New("read: written token not found")
+		}
+		return nil
+	}
+}
+
+// Verify issues a low-complexity challenge with the current secret and
+// algorithm, solves it, verifies the payload through VerifyPayload and checks
+// that a second verification is rejected as a replay. The synthetic payload
+// goes to a store of its own, so it never evicts a real one from a store
+// bounded by MAXRECORDS.
+func Verify(h *config.Holder) func(ctx context.Context) error {
+	s := store.NewMemoryStore(1)
+	return func(ctx context.Context) error {
+		cfg := h.Get()
+		ch, err := handler.NewChallenge(cfg, cfg.Algorithm, syntheticMaxNumber)
+		if err != nil {
+			return fmt.Errorf("create challenge: %w", err)
+		}
+		sol, err := solver.Solve(ctx, ch, solver.Options{Workers: 1})
+		if err != nil {
+			return fmt.Errorf("solve challenge: %w", err)
+		}
+		payload := solver.Payload(ch, sol.Number)
+
+		res, err := handler.VerifyPayload(cfg, s, payload)
+		if err != nil {
+			return fmt.Errorf("verify: %w", err)
+		}
+		if !res.Verified {
+			return fmt.Errorf("verify: payload rejected (%s)", res.Reason)
+		}
+
+		res, err = handler.VerifyPayload(cfg, s, payload)
+		if err != nil {
+			return fmt.Errorf("replay: %w", err)
+		}
+		if res.Reason != handler.ReasonReplay {
+			return fmt.Errorf("replay: payload not rejected (%s)", res.Reason)
+		}
+		return nil
+	}
+}
+
+// GeoIP looks up a known address in each loaded database.
+func GeoIP(g *analytics.GeoIP) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return g.Check()
+	}
+}
+
+// OIDC fetches the issuer's discovery document.
+func OIDC(h *config.Holder) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		url := strings.TrimSuffix(h.Get().AuthIssuer, "/") + "/.well-known/openid-configuration"
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("discovery returned %d", resp.StatusCode)
+		}
+		var disco struct {
+			Issuer string `json:"issuer"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&disco); err != nil {
+			return fmt.Errorf("decode discovery: %w", err)
+		}
+		if disco.Issuer == "" {
+			return errors.New("discovery document has no issuer")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*CounterVec
+)
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]uint64),
+	}
+	registryMu.Lock()
+	registry = append(registry, c)
+	registryMu.Unlock()
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(n uint64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	c.mu.Lock()
+	c.values[key] += n
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) write(b *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(b, "# TYPE %s counter\n", c.name)
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		b.WriteString(c.name)
+		if len(c.labels) > 0 {
+			values := strings.Split(k, "\x00")
+			b.WriteString("{")
+			for i, l := range c.labels {
+				if i > 0 {
+					b.WriteString(",")
+				}
+				v := ""
+				if i < len(values) {
+					v = values[i]
+				}
+				fmt.Fprintf(b, "%s=%q", l, v)
+			}
+			b.WriteString("}")
+		}
+		fmt.Fprintf(b, " %d\n", c.values[k])
+	}
+}
+
+// Handler exposes all registered counters in the Prometheus text format.
+func Handler() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		registryMu.Lock()
+		vecs := append([]*CounterVec(nil), registry...)
+		registryMu.Unlock()
+
+		var b strings.Builder
+		for _, v := range vecs {
+			v.write(&b)
+		}
+		return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+	}
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"github.com/labstack/echo/v4"
+
+	"altcha/pkg/config"
+)
+
+// IPExtractor returns how c.RealIP finds the client IP. Without
+// TRUSTED_PROXIES it is the address of the connection, so X-Forwarded-For and
+// X-Real-IP can't be spoofed. With them, X-Forwarded-For is read back to the
+// first address that isn't a trusted proxy; loopback and private networks are
+// only trusted when listed.
+func IPExtractor(cfg *config.Config) echo.IPExtractor {
+	nets := cfg.TrustedProxyNets()
+	if len(nets) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	opts := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, n := range nets {
+		opts = append(opts, echo.TrustIPRange(n))
+	}
+	return echo.ExtractIPFromXFFHeader(opts...)
+}
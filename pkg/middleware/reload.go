@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	echomw "github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
+
+	"altcha/pkg/config"
+)
+
+// RateLimit limits requests per client IP to RATE_LIMIT per second. A
+// reloaded limit replaces the limiter; 0 disables it.
+func RateLimit(h *config.Holder) echo.MiddlewareFunc {
+	return reloadable(h,
+		func(cfg *config.Config) string { return strconv.FormatFloat(cfg.RateLimit, 'g', -1, 64) },
+		func(cfg *config.Config) echo.MiddlewareFunc {
+			if cfg.RateLimit <= 0 {
+				return passThrough
+			}
+			return echomw.RateLimiter(echomw.NewRateLimiterMemoryStore(rate.Limit(cfg.RateLimit)))
+		})
+}
+
+// CORS allows the origins in CORS_ORIGIN, or any origin when it is empty.
+func CORS(h *config.Holder) echo.MiddlewareFunc {
+	return reloadable(h,
+		func(cfg *config.Config) string { return strings.Join(cfg.CorsOrigin, ",") },
+		func(cfg *config.Config) echo.MiddlewareFunc {
+			if len(cfg.CorsOrigin) > 0 {
+				return echomw.CORSWithConfig(echomw.CORSConfig{
+					AllowOrigins: cfg.CorsOrigin,
+				})
+			}
+			return echomw.CORS()
+		})
+}
+
+func passThrough(next echo.HandlerFunc) echo.HandlerFunc {
+	return next
+}
+
+// reloadable rebuilds the middleware returned by build whenever key reports a
+// different value for the current configuration.
+func reloadable(h *config.Holder, key func(*config.Config) string, build func(*config.Config) echo.MiddlewareFunc) echo.MiddlewareFunc {
+	var (
+		mu      sync.Mutex
+		current string
+		mw      echo.MiddlewareFunc
+	)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			cfg := h.Get()
+			k := key(cfg)
+			mu.Lock()
+			if mw == nil || k != current {
+				current, mw = k, build(cfg)
+			}
+			m := mw
+			mu.Unlock()
+			return m(next)(c)
+		}
+	}
+}
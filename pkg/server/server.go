@@ -6,18 +6,26 @@ import (
 
 	"github.com/labstack/echo/v4"
 	echomw "github.com/labstack/echo/v4/middleware"
-	"golang.org/x/time/rate"
 
+	"altcha/pkg/access"
+	"altcha/pkg/admin"
 	"altcha/pkg/analytics"
+	"altcha/pkg/apikey"
+	"altcha/pkg/assets"
 	"altcha/pkg/config"
+	"altcha/pkg/gate"
 	"altcha/pkg/handler"
+	"altcha/pkg/health"
+	"altcha/pkg/metrics"
 	"altcha/pkg/middleware"
 	"altcha/pkg/store"
 )
 
-func NewAPIServer(cfg *config.Config, s store.Store, collector *analytics.Collector) *echo.Echo {
+func NewAPIServer(h *config.Holder, s store.Store, collector *analytics.Collector, keys *apikey.Keyring, list *access.List, checker *health.Checker) *echo.Echo {
+	cfg := h.Get()
 	e := echo.New()
 	e.HideBanner = true
+	e.IPExtractor = middleware.IPExtractor(cfg)
 
 	loggerConfig := echomw.LoggerConfig{
 		Format: "[API] ${time_rfc3339} ${remote_ip} ${method} ${uri} ${status} ${latency_human}\n",
@@ -29,19 +37,45 @@ func NewAPIServer(cfg *config.Config, s store.Store, collector *analytics.Collec
 	}
 	e.Use(echomw.LoggerWithConfig(loggerConfig))
 
-	if cfg.RateLimit > 0 {
-		e.Use(echomw.RateLimiter(echomw.NewRateLimiterMemoryStore(
-			rate.Limit(cfg.RateLimit),
-		)))
+	e.Use(middleware.RateLimit(h))
+	e.Use(middleware.CORS(h))
+
+	if collector != nil {
+		e.Use(analytics.Middleware(collector))
 	}
 
-	if len(cfg.CorsOrigin) > 0 {
-		e.Use(echomw.CORSWithConfig(echomw.CORSConfig{
-			AllowOrigins: cfg.CorsOrigin,
-		}))
-	} else {
-		e.Use(echomw.CORS())
+	e.GET("/", func(c echo.Context) error {
+		return c.NoContent(http.StatusNoContent)
+	})
+	e.GET("/challenge", handler.Challenge(h), access.Middleware(list))
+
+	// Without a dedicated internal listener, /verify and health checks share
+	// the public port.
+	if !cfg.InternalEnabled() {
+		registerInternalRoutes(e, h, s, keys, list, checker, true)
+	}
+
+	return e
+}
+
+// NewInternalServer serves the server-to-server endpoints (/verify,
+// /forward-auth, health checks and metrics) on a separate port that is not
+// meant to be exposed publicly.
+func NewInternalServer(h *config.Holder, s store.Store, collector *analytics.Collector, keys *apikey.Keyring, list *access.List, checker *health.Checker) *echo.Echo {
+	cfg := h.Get()
+	e := echo.New()
+	e.HideBanner = true
+	e.IPExtractor = middleware.IPExtractor(cfg)
+
+	loggerConfig := echomw.LoggerConfig{
+		Format: "[INTERNAL] ${time_rfc3339} ${remote_ip} ${method} ${uri} ${status} ${latency_human}\n",
+	}
+	if !cfg.IsDebug() {
+		loggerConfig.Skipper = func(c echo.Context) bool {
+			return strings.HasPrefix(c.Path(), "/health/")
+		}
 	}
+	e.Use(echomw.LoggerWithConfig(loggerConfig))
 
 	if collector != nil {
 		e.Use(analytics.Middleware(collector))
@@ -50,15 +84,89 @@ func NewAPIServer(cfg *config.Config, s store.Store, collector *analytics.Collec
 	e.GET("/", func(c echo.Context) error {
 		return c.NoContent(http.StatusNoContent)
 	})
+	registerInternalRoutes(e, h, s, keys, list, checker, false)
+
+	return e
+}
+
+// registerInternalRoutes adds the server-to-server endpoints. On the public
+// port /health/deep and /metrics require an API key, and are left out
+// without VERIFY_API_KEYS_FILE. Block rules apply to /forward-auth, whose
+// client IP a trusted proxy passes on.
+func registerInternalRoutes(e *echo.Echo, h *config.Holder, s store.Store, keys *apikey.Keyring, list *access.List, checker *health.Checker, public bool) {
 	e.GET("/health/live", handler.HealthLive())
 	e.GET("/health/ready", handler.HealthReady(s))
-	e.GET("/challenge", handler.Challenge(cfg))
-	e.GET("/verify", handler.Verify(cfg, s))
+	switch {
+	case !public:
+		e.GET("/health/deep", checker.Handler())
+		e.GET("/metrics", metrics.Handler())
+	case keys != nil:
+		e.GET("/health/deep", checker.Handler(), requireKey(keys))
+		e.GET("/metrics", metrics.Handler(), requireKey(keys))
+	}
+
+	var mw []echo.MiddlewareFunc
+	if keys != nil {
+		mw = append(mw, apikey.Middleware(keys))
+	}
+	e.GET("/verify", handler.Verify(h, s), mw...)
+	mw = append(mw, access.BlockMiddleware(list))
+	e.Any("/forward-auth", handler.ForwardAuth(h, s), mw...)
+}
+
+// requireKey answers 401 without a valid API key. Unlike apikey.Middleware it
+// neither rate limits nor counts the request as a /verify call.
+func requireKey(kr *apikey.Keyring) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if _, ok := kr.Lookup(apikey.KeyFromRequest(c.Request())); !ok {
+				return c.NoContent(http.StatusUnauthorized)
+			}
+			return next(c)
+		}
+	}
+}
+
+// NewAdminServer serves the admin API. Every request is written to the audit
+// log.
+func NewAdminServer(h *config.Holder, api *admin.API, keys *apikey.Keyring, audit *admin.Auditor) *echo.Echo {
+	e := echo.New()
+	e.HideBanner = true
+	e.IPExtractor = middleware.IPExtractor(h.Get())
+
+	e.Use(echomw.LoggerWithConfig(echomw.LoggerConfig{
+		Format: "[ADMIN] ${time_rfc3339} ${remote_ip} ${method} ${uri} ${status} ${latency_human}\n",
+	}))
+	e.Use(audit.Middleware())
+
+	api.Register(e, keys)
+
+	return e
+}
+
+// NewGateServer proxies every request to the gate upstream, requiring a valid
+// altcha payload for requests matching the gate rules. The access rules apply
+// to the gate's challenge and clearance like to /challenge.
+func NewGateServer(h *config.Holder, g *gate.Gate, list *access.List) *echo.Echo {
+	cfg := h.Get()
+	e := echo.New()
+	e.HideBanner = true
+	e.IPExtractor = middleware.IPExtractor(cfg)
+
+	e.Use(echomw.LoggerWithConfig(echomw.LoggerConfig{
+		Format: "[GATE] ${time_rfc3339} ${remote_ip} ${method} ${uri} ${status} ${latency_human}\n",
+	}))
+
+	e.GET(gate.PathPrefix+"/challenge", handler.Challenge(h), access.Middleware(list))
+	e.GET(gate.PathPrefix+"/altcha.min.js", assets.New(cfg.WebDir).File("demo/altcha.min.js"))
+	e.POST(gate.PathPrefix+"/clearance", g.Clearance(), access.Middleware(list))
+	e.Any("/*", g.Handler())
 
 	return e
 }
 
-func NewDemoServer(cfg *config.Config) *echo.Echo {
+func NewDemoServer(h *config.Holder, s store.Store) *echo.Echo {
+	cfg := h.Get()
 	e := echo.New()
 	e.HideBanner = true
 
@@ -69,9 +177,11 @@ func NewDemoServer(cfg *config.Config) *echo.Echo {
 	}
 	e.Use(middleware.DemoCSP())
 
-	e.GET("/", handler.DemoPage())
-	e.GET("/challenge", handler.DemoChallenge(cfg))
-	e.POST("/test", handler.DemoTest(cfg))
+	a := assets.New(cfg.WebDir)
+	e.GET("/", handler.DemoPage(a))
+	e.GET("/demo.js", a.File("demo/demo.js"))
+	e.GET("/challenge", handler.DemoChallenge(h))
+	e.POST("/test", handler.DemoTest(h, s))
 
 	return e
 }
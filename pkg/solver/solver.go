@@ -0,0 +1,180 @@
+// Package solver solves ALTCHA challenges without a browser, for E2E tests
+// and synthetic monitoring of protected flows.
+package solver
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	altcha "github.com/altcha-org/altcha-lib-go"
+)
+
+var (
+	// ErrNotFound is returned when no number up to maxNumber solves the
+	// challenge, e.g. because it was not created by an ALTCHA server.
+	ErrNotFound = errors.New("solver: no solution found")
+	// ErrTimeout is returned when MaxTime elapsed before a solution was found.
+	ErrTimeout = errors.New("solver: time budget exceeded")
+)
+
+type Options struct {
+	// Workers is the number of goroutines searching in parallel. Default
+	// runtime.NumCPU().
+	Workers int
+	// MaxTime bounds the search. 0 means no limit besides the context.
+	MaxTime time.Duration
+	// HTTPClient is used by Fetch and SolveURL. Default http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+type Solution struct {
+	Number int64
+	Took   time.Duration
+}
+
+// Solve searches 0..ch.MaxNumber for the number solving ch. The range is split
+// into one contiguous slice per worker; the first solution found stops the
+// others.
+func Solve(ctx context.Context, ch altcha.Challenge, opts Options) (*Solution, error) {
+	maxNumber := ch.MaxNumber
+	if maxNumber <= 0 {
+		maxNumber = altcha.DefaultMaxNumber
+	}
+	workers := int64(opts.Workers)
+	if workers <= 0 {
+		workers = int64(runtime.NumCPU())
+	}
+	workers = min(workers, maxNumber+1)
+
+	if opts.MaxTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.MaxTime)
+		defer cancel()
+	}
+
+	start := time.Now()
+	stop := make(chan struct{})
+	found := make(chan int, workers)
+	errs := make(chan error, workers)
+
+	var wg sync.WaitGroup
+	size := (maxNumber + 1) / workers
+	for i := range workers {
+		from := i * size
+		to := from + size - 1
+		if i == workers-1 {
+			to = maxNumber
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sol, err := altcha.SolveChallenge(ch.Challenge, ch.Salt, altcha.Algorithm(ch.Algorithm), int(to), int(from), stop)
+			switch {
+			case err != nil:
+				errs <- err
+			case sol != nil:
+				found <- sol.Number
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case n := <-found:
+		close(stop)
+		return &Solution{Number: int64(n), Took: time.Since(start)}, nil
+	case err = <-errs:
+	case <-done:
+		// A worker may have sent its result just before the last one exited.
+		select {
+		case n := <-found:
+			return &Solution{Number: int64(n), Took: time.Since(start)}, nil
+		default:
+		}
+		err = ErrNotFound
+	case <-ctx.Done():
+		err = ctx.Err()
+		if errors.Is(err, context.DeadlineExceeded) && opts.MaxTime > 0 {
+			err = ErrTimeout
+		}
+	}
+	close(stop)
+	return nil, err
+}
+
+// Payload returns the base64 payload the widget would submit for ch and number.
+func Payload(ch altcha.Challenge, number int64) string {
+	b, _ := json.Marshal(altcha.Payload{
+		Algorithm: ch.Algorithm,
+		Challenge: ch.Challenge,
+		Number:    number,
+		Salt:      ch.Salt,
+		Signature: ch.Signature,
+	})
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// Fetch requests a challenge from url, e.g. http://localhost:3000/challenge.
+func Fetch(ctx context.Context, url string, opts Options) (altcha.Challenge, error) {
+	var ch altcha.Challenge
+
+	client := opts.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return ch, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ch, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ch, fmt.Errorf("solver: %s responded %d", url, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ch); err != nil {
+		return ch, fmt.Errorf("solver: invalid challenge: %w", err)
+	}
+	if ch.Challenge == "" || ch.Salt == "" {
+		return ch, errors.New("solver: invalid challenge: missing challenge or salt")
+	}
+	return ch, nil
+}
+
+// SolveURL fetches a challenge from url, solves it and returns the payload.
+// MaxTime covers fetching and solving.
+func SolveURL(ctx context.Context, url string, opts Options) (string, *Solution, error) {
+	if opts.MaxTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.MaxTime)
+		defer cancel()
+	}
+	ch, err := Fetch(ctx, url, opts)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && opts.MaxTime > 0 {
+			return "", nil, ErrTimeout
+		}
+		return "", nil, err
+	}
+	sol, err := Solve(ctx, ch, opts)
+	if err != nil {
+		return "", nil, err
+	}
+	return Payload(ch, sol.Number), sol, nil
+}
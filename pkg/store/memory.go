@@ -35,5 +35,13 @@ func (s *MemoryStore) Add(token string) error {
 	return nil
 }
 
+func (s *MemoryStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records = nil
+	return nil
+}
+
 func (s *MemoryStore) Ping() error  { return nil }
 func (s *MemoryStore) Close() error { return nil }
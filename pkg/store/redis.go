@@ -14,22 +14,39 @@ type RedisStore struct {
 	closer func() error
 }
 
-func NewRedisStore(url string, cluster bool, ttlMinutes int) (*RedisStore, error) {
+// NewRedisStore connects to the addresses in url(). The URL is consulted again
+// for credentials whenever a new connection is opened, so a rotated REDIS_URL
+// password applies without a restart.
+func NewRedisStore(url func() string, cluster bool, ttlMinutes int) (*RedisStore, error) {
 	ttl := time.Duration(ttlMinutes) * time.Minute
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if cluster || strings.Contains(url, ",") {
+	if cluster || strings.Contains(url(), ",") {
 		return newClusterStore(ctx, url, ttl)
 	}
 	return newSingleStore(ctx, url, ttl)
 }
 
-func newSingleStore(ctx context.Context, url string, ttl time.Duration) (*RedisStore, error) {
-	opts, err := redis.ParseURL(url)
+// credentials returns the username and password of the first URL in url().
+func credentials(url func() string) func() (string, string) {
+	return func() (string, string) {
+		first, _, _ := strings.Cut(url(), ",")
+		opts, err := redis.ParseURL(strings.TrimSpace(first))
+		if err != nil {
+			return "", ""
+		}
+		return opts.Username, opts.Password
+	}
+}
+
+func newSingleStore(ctx context.Context, url func() string, ttl time.Duration) (*RedisStore, error) {
+	opts, err := redis.ParseURL(url())
 	if err != nil {
 		return nil, err
 	}
+	opts.Username, opts.Password = "", ""
+	opts.CredentialsProvider = credentials(url)
 
 	client := redis.NewClient(opts)
 	if err := client.Ping(ctx).Err(); err != nil {
@@ -39,16 +56,20 @@ func newSingleStore(ctx context.Context, url string, ttl time.Duration) (*RedisS
 	return &RedisStore{client: client, ttl: ttl, closer: client.Close}, nil
 }
 
-func newClusterStore(ctx context.Context, url string, ttl time.Duration) (*RedisStore, error) {
+func newClusterStore(ctx context.Context, url func() string, ttl time.Duration) (*RedisStore, error) {
 	var addrs []string
-	for _, a := range strings.Split(url, ",") {
+	for _, a := range strings.Split(url(), ",") {
 		a = strings.TrimSpace(a)
 		a = strings.TrimPrefix(a, "redis://")
+		if _, host, ok := strings.Cut(a, "@"); ok {
+			a = host
+		}
 		addrs = append(addrs, a)
 	}
 
 	client := redis.NewClusterClient(&redis.ClusterOptions{
-		Addrs: addrs,
+		Addrs:               addrs,
+		CredentialsProvider: credentials(url),
 	})
 	if err := client.Ping(ctx).Err(); err != nil {
 		return nil, err
@@ -69,6 +90,27 @@ func (s *RedisStore) Add(token string) error {
 	return s.client.Set(context.Background(), "altcha:"+token, "1", s.ttl).Err()
 }
 
+// Flush deletes every altcha:* key. In cluster mode each master is scanned.
+func (s *RedisStore) Flush() error {
+	ctx := context.Background()
+	if cc, ok := s.client.(*redis.ClusterClient); ok {
+		return cc.ForEachMaster(ctx, func(ctx context.Context, c *redis.Client) error {
+			return flushKeys(ctx, c)
+		})
+	}
+	return flushKeys(ctx, s.client)
+}
+
+func flushKeys(ctx context.Context, c redis.Cmdable) error {
+	iter := c.Scan(ctx, 0, "altcha:*", 1000).Iterator()
+	for iter.Next(ctx) {
+		if err := c.Del(ctx, iter.Val()).Err(); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
 func (s *RedisStore) Ping() error {
 	return s.client.Ping(context.Background()).Err()
 }
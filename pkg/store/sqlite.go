@@ -55,5 +55,10 @@ func (s *SQLiteStore) Add(token string) error {
 	return err
 }
 
+func (s *SQLiteStore) Flush() error {
+	_, err := s.db.Exec("DELETE FROM tokens")
+	return err
+}
+
 func (s *SQLiteStore) Ping() error  { return s.db.Ping() }
 func (s *SQLiteStore) Close() error { return s.db.Close() }
@@ -3,6 +3,8 @@ package store
 type Store interface {
 	Exists(token string) (bool, error)
 	Add(token string) error
+	// Flush forgets every used token.
+	Flush() error
 	Ping() error
 	Close() error
 }
@@ -2,31 +2,67 @@
   "use strict";
 
   let chart = null;
+  let solveChart = null;
 
   const rangeSelect = document.getElementById("range-select");
   const customRange = document.getElementById("custom-range");
   const dateFrom = document.getElementById("date-from");
   const dateTo = document.getElementById("date-to");
   const btnApply = document.getElementById("btn-apply");
+  const bucketSelect = document.getElementById("bucket-select");
+  const dimensionSelect = document.getElementById("dimension-select");
+  const topBySelect = document.getElementById("top-by-select");
+  const topSortSelect = document.getElementById("top-sort-select");
+  const timeZone = Intl.DateTimeFormat().resolvedOptions().timeZone || "UTC";
+
+  // Bucket picked when the range changes; can be overridden afterwards.
+  const DEFAULT_BUCKETS = { "1h": "minute", "24h": "hour" };
 
   rangeSelect.addEventListener("change", function () {
     if (this.value === "custom") {
       customRange.classList.remove("hidden");
     } else {
       customRange.classList.add("hidden");
+      bucketSelect.value = DEFAULT_BUCKETS[this.value] || "day";
       refreshDashboard();
     }
   });
 
+  bucketSelect.addEventListener("change", function () {
+    refreshDashboard();
+  });
+
   btnApply.addEventListener("click", function () {
     refreshDashboard();
   });
 
+  dimensionSelect.addEventListener("change", function () {
+    refreshBreakdown(queryString()).catch(function (err) {
+      console.error("Breakdown refresh error:", err);
+    });
+  });
+
+  [topBySelect, topSortSelect].forEach(function (select) {
+    select.addEventListener("change", function () {
+      refreshTop(queryString()).catch(function (err) {
+        console.error("Top refresh error:", err);
+      });
+    });
+  });
+
   function getTimeRange() {
     const days = rangeSelect.value;
     if (days === "custom") {
       return { from: dateFrom.value, to: dateTo.value };
     }
+    if (days === "1h" || days === "24h") {
+      const now = new Date();
+      const hours = days === "1h" ? 1 : 24;
+      return {
+        from: new Date(now.getTime() - hours * 3600 * 1000).toISOString(),
+        to: now.toISOString(),
+      };
+    }
     const to = new Date();
     const from = new Date();
     from.setDate(from.getDate() - parseInt(days));
@@ -36,8 +72,15 @@
     };
   }
 
+  // Local calendar date; the server reads it in the tz query parameter.
   function formatDate(d) {
-    return d.toISOString().slice(0, 10);
+    return (
+      d.getFullYear() +
+      "-" +
+      String(d.getMonth() + 1).padStart(2, "0") +
+      "-" +
+      String(d.getDate()).padStart(2, "0")
+    );
   }
 
   async function fetchJSON(url) {
@@ -50,20 +93,39 @@
     return resp.json();
   }
 
-  async function refreshDashboard() {
+  function queryString() {
     const range = getTimeRange();
-    const qs = "from=" + range.from + "&to=" + range.to;
+    return (
+      "from=" +
+      encodeURIComponent(range.from) +
+      "&to=" +
+      encodeURIComponent(range.to) +
+      "&tz=" +
+      encodeURIComponent(timeZone)
+    );
+  }
+
+  async function refreshDashboard() {
+    const qs = queryString();
 
     try {
-      const [summary, timeseries, locations] = await Promise.all([
-        fetchJSON("/api/summary?" + qs),
-        fetchJSON("/api/timeseries?" + qs),
-        fetchJSON("/api/locations?" + qs),
-      ]);
+      const [summary, timeseries, locations, funnel, solveTimes, anomalies] =
+        await Promise.all([
+          fetchJSON("/api/summary?" + qs),
+          fetchJSON("/api/timeseries?" + qs + "&bucket=" + bucketSelect.value),
+          fetchJSON("/api/locations?" + qs),
+          fetchJSON("/api/funnel?" + qs),
+          fetchJSON("/api/solve-times?" + qs),
+          fetchJSON("/api/anomalies"),
+        ]);
 
       renderKPICards(summary);
+      renderAnomalies(anomalies);
       renderChart(timeseries);
       renderLocations(locations);
+      renderFunnel(funnel);
+      renderSolveTimes(solveTimes);
+      await Promise.all([refreshTop(qs), refreshBreakdown(qs)]);
     } catch (err) {
       console.error("Dashboard refresh error:", err);
     }
@@ -80,6 +142,16 @@
         value: s.avg_latency_ms.toFixed(1) + " ms",
         cls: "",
       },
+      {
+        label: "P95 Latency",
+        value: s.p95_latency_ms.toFixed(1) + " ms",
+        cls: "",
+      },
+      {
+        label: "P99 Latency",
+        value: s.p99_latency_ms.toFixed(1) + " ms",
+        cls: "",
+      },
       { label: "4XX Errors", value: fmtNum(s.errors_4xx), cls: "error" },
       { label: "5XX Errors", value: fmtNum(s.errors_5xx), cls: "error" },
       { label: "Requests", value: fmtNum(s.total_requests), cls: "" },
@@ -161,6 +233,9 @@
             pointRadius: 3,
             order: 1,
           },
+          latencyLine(data, "p50_latency", "P50 Latency (ms)", "#8e44ad"),
+          latencyLine(data, "p95_latency", "P95 Latency (ms)", "#d35400"),
+          latencyLine(data, "p99_latency", "P99 Latency (ms)", "#c0392b"),
         ],
       },
       options: {
@@ -185,6 +260,240 @@
     });
   }
 
+  function renderFunnel(data) {
+    var t = data.total;
+    var cards = [
+      { label: "Issued", value: fmtNum(t.issued), cls: "" },
+      { label: "Verified", value: fmtNum(t.verified), cls: "success" },
+      { label: "Conversion", value: fmtPct(t.conversion), cls: "success" },
+      { label: "Abandoned", value: fmtNum(t.abandoned), cls: "error" },
+      { label: "Abandonment", value: fmtPct(t.abandon_rate), cls: "error" },
+    ];
+    document.getElementById("funnel-grid").innerHTML = cards
+      .map(function (c) {
+        return (
+          '<div class="kpi-card ' +
+          c.cls +
+          '">' +
+          '<div class="kpi-value">' +
+          c.value +
+          "</div>" +
+          '<div class="kpi-label">' +
+          c.label +
+          "</div>" +
+          "</div>"
+        );
+      })
+      .join("");
+
+    var tbody = document.querySelector("#funnel-table tbody");
+    if (!data.forms.length) {
+      tbody.innerHTML =
+        '<tr><td colspan="7" class="empty">No challenges in this range</td></tr>';
+      return;
+    }
+    tbody.innerHTML = data.forms
+      .map(function (f) {
+        return (
+          "<tr>" +
+          "<td>" +
+          (f.form ? escapeHTML(f.form) : '<span class="muted">(none)</span>') +
+          "</td>" +
+          "<td>" +
+          fmtNum(f.issued) +
+          "</td>" +
+          "<td>" +
+          fmtNum(f.verified) +
+          "</td>" +
+          "<td>" +
+          fmtNum(f.pending) +
+          "</td>" +
+          "<td>" +
+          fmtNum(f.abandoned) +
+          "</td>" +
+          "<td>" +
+          fmtPct(f.abandon_rate) +
+          "</td>" +
+          "<td>" +
+          fmtPct(f.conversion) +
+          "</td>" +
+          "</tr>"
+        );
+      })
+      .join("");
+  }
+
+  async function refreshBreakdown(qs) {
+    const dimension = dimensionSelect.value;
+    const entries = await fetchJSON(
+      "/api/breakdown/" + dimension + "?" + qs
+    );
+    renderEntries("#breakdown-table", dimension, entries);
+  }
+
+  async function refreshTop(qs) {
+    const by = topBySelect.value;
+    const entries = await fetchJSON(
+      "/api/top/" + by + "?" + qs + "&sort=" + topSortSelect.value
+    );
+    renderEntries("#top-table", by, entries);
+  }
+
+  // renderEntries fills the table of a breakdown or top list; key is the
+  // dimension or group.
+  function renderEntries(table, key, entries) {
+    var tbody = document.querySelector(table + " tbody");
+    if (!entries.length) {
+      tbody.innerHTML =
+        '<tr><td colspan="6" class="empty">No events in this range</td></tr>';
+      return;
+    }
+    tbody.innerHTML = entries
+      .map(function (e) {
+        var value = e.value
+          ? escapeHTML(key === "asn" ? "AS" + e.value : e.value)
+          : '<span class="muted">(none)</span>';
+        if (e.label) {
+          value += ' <span class="muted">' + escapeHTML(e.label) + "</span>";
+        }
+        return (
+          "<tr>" +
+          "<td>" +
+          value +
+          "</td>" +
+          "<td>" +
+          fmtNum(e.requests) +
+          "</td>" +
+          "<td>" +
+          fmtNum(e.challenges) +
+          "</td>" +
+          "<td>" +
+          fmtNum(e.verified) +
+          "</td>" +
+          "<td>" +
+          fmtNum(e.failed) +
+          "</td>" +
+          "<td>" +
+          fmtPct(e.failure_rate) +
+          "</td>" +
+          "</tr>"
+        );
+      })
+      .join("");
+  }
+
+  function renderAnomalies(report) {
+    document.getElementById("anomaly-window").textContent =
+      "last hour vs. previous 24 hours";
+    var tbody = document.querySelector("#anomaly-table tbody");
+    if (!report.anomalies.length) {
+      tbody.innerHTML =
+        '<tr><td colspan="5" class="empty">No spikes detected</td></tr>';
+      return;
+    }
+    tbody.innerHTML = report.anomalies
+      .map(function (a) {
+        var scope =
+          a.scope === "all"
+            ? "All traffic"
+            : escapeHTML(a.scope) + " <b>" + escapeHTML(a.key) + "</b>";
+        if (a.label) {
+          scope += ' <span class="muted">' + escapeHTML(a.label) + "</span>";
+        }
+        return (
+          "<tr>" +
+          "<td>" +
+          scope +
+          "</td>" +
+          "<td>" +
+          (a.metric === "failed" ? "Failed verifications" : "Challenges") +
+          "</td>" +
+          "<td>" +
+          fmtNum(a.current) +
+          "</td>" +
+          "<td>" +
+          a.mean.toFixed(1) +
+          " ± " +
+          a.stddev.toFixed(1) +
+          "</td>" +
+          '<td class="z-high">' +
+          a.z.toFixed(1) +
+          "</td>" +
+          "</tr>"
+        );
+      })
+      .join("");
+  }
+
+  function renderSolveTimes(data) {
+    document.getElementById("solve-stats").innerHTML =
+      "<span>Solved: <b>" +
+      fmtNum(data.count) +
+      "</b></span>" +
+      "<span>p50: <b>" +
+      fmtSecs(data.p50) +
+      "</b></span>" +
+      "<span>p90: <b>" +
+      fmtSecs(data.p90) +
+      "</b></span>" +
+      "<span>p99: <b>" +
+      fmtSecs(data.p99) +
+      "</b></span>";
+
+    var ctx = document.getElementById("solve-chart").getContext("2d");
+    if (solveChart) {
+      solveChart.destroy();
+    }
+    solveChart = new Chart(ctx, {
+      type: "bar",
+      data: {
+        labels: data.buckets.map(function (b) {
+          return b.label;
+        }),
+        datasets: [
+          {
+            label: "Verifications",
+            data: data.buckets.map(function (b) {
+              return b.count;
+            }),
+            backgroundColor: "rgba(43, 196, 172, 0.7)",
+          },
+        ],
+      },
+      options: {
+        responsive: true,
+        plugins: { legend: { display: false } },
+        scales: {
+          y: {
+            beginAtZero: true,
+            title: { display: true, text: "Count" },
+          },
+          x: {
+            title: { display: true, text: "Time from challenge to verification" },
+          },
+        },
+      },
+    });
+  }
+
+  function latencyLine(data, key, label, color) {
+    return {
+      type: "line",
+      label: label,
+      data: data.map(function (d) {
+        return d[key];
+      }),
+      borderColor: color,
+      backgroundColor: "transparent",
+      borderDash: [4, 3],
+      yAxisID: "y1",
+      tension: 0.3,
+      pointRadius: 0,
+      order: 1,
+      hidden: key === "p50_latency",
+    };
+  }
+
   // Country code → flag emoji
   var FLAG_OFFSET = 0x1f1e6 - 65;
   function countryFlag(code) {
@@ -227,7 +536,12 @@
       return;
     }
 
-    // Group by continent
+    container.innerHTML = locationsHTML(data);
+  }
+
+  // locationsHTML lists entries of continent, country, count and percent
+  // grouped by continent.
+  function locationsHTML(data) {
     var groups = {};
     data.forEach(function (entry) {
       var continent = entry.continent || "Unknown";
@@ -265,8 +579,216 @@
       });
       html += "</div>";
     });
+    return html;
+  }
+
+  // Live view: the buckets of /api/live for the last LIVE_SECONDS seconds,
+  // summed per second across API server replicas. Events arrive once the
+  // server flushes them, so the view ends LIVE_DELAY seconds ago.
+  var LIVE_SECONDS = 60;
+  var LIVE_DELAY = 2;
+  var LIVE_RATE_SECONDS = 10;
+  var liveBuckets = {};
+  var liveSource = null;
+  var liveChart = null;
+  var liveToggle = document.getElementById("live-toggle");
+  var liveStatus = document.getElementById("live-status");
+
+  liveToggle.addEventListener("click", function () {
+    if (liveSource) {
+      stopLive();
+    } else {
+      startLive();
+    }
+  });
+
+  function startLive() {
+    liveSource = new EventSource("/api/live");
+    liveSource.onopen = function () {
+      liveStatus.textContent = "last " + LIVE_SECONDS + " seconds";
+    };
+    liveSource.onerror = function () {
+      liveStatus.textContent = "reconnecting…";
+    };
+    liveSource.onmessage = function (ev) {
+      addLiveBucket(JSON.parse(ev.data));
+    };
+    liveToggle.textContent = "Pause";
+    liveStatus.textContent = "connecting…";
+  }
+
+  function stopLive() {
+    liveSource.close();
+    liveSource = null;
+    liveToggle.textContent = "Resume";
+    liveStatus.textContent = "paused";
+  }
+
+  function addLiveBucket(b) {
+    var cur = liveBuckets[b.t];
+    if (!cur) {
+      cur = liveBuckets[b.t] = {
+        requests: 0,
+        challenges: 0,
+        verified: 0,
+        failed: 0,
+        errors: 0,
+        locations: {},
+      };
+    }
+    ["requests", "challenges", "verified", "failed", "errors"].forEach(
+      function (k) {
+        cur[k] += b[k];
+      }
+    );
+    (b.locations || []).forEach(function (l) {
+      var key = l.continent + "/" + l.country;
+      cur.locations[key] = (cur.locations[key] || 0) + l.count;
+    });
+  }
+
+  function renderLive() {
+    if (!liveSource) return;
+    var end = Math.floor(Date.now() / 1000) - LIVE_DELAY;
+    var start = end - LIVE_SECONDS + 1;
+    Object.keys(liveBuckets).forEach(function (t) {
+      if (t < start) delete liveBuckets[t];
+    });
+
+    var seconds = [];
+    for (var t = start; t <= end; t++) seconds.push(t);
+    var series = function (k) {
+      return seconds.map(function (t) {
+        return liveBuckets[t] ? liveBuckets[t][k] : 0;
+      });
+    };
+    var sum = function (values) {
+      return values.reduce(function (a, b) {
+        return a + b;
+      }, 0);
+    };
+
+    var data = {
+      requests: series("requests"),
+      challenges: series("challenges"),
+      verified: series("verified"),
+      failed: series("failed"),
+    };
+    var errors = sum(series("errors"));
+    var rate =
+      sum(data.requests.slice(-LIVE_RATE_SECONDS)) / LIVE_RATE_SECONDS;
+    var cards = [
+      { label: "Requests/s", value: rate.toFixed(1), cls: "" },
+      { label: "Challenges", value: fmtNum(sum(data.challenges)), cls: "" },
+      { label: "Verified", value: fmtNum(sum(data.verified)), cls: "success" },
+      { label: "Failed", value: fmtNum(sum(data.failed)), cls: "error" },
+      { label: "5XX Errors", value: fmtNum(errors), cls: "error" },
+    ];
+    document.getElementById("live-grid").innerHTML = cards
+      .map(function (c) {
+        return (
+          '<div class="kpi-card ' +
+          c.cls +
+          '">' +
+          '<div class="kpi-value">' +
+          c.value +
+          "</div>" +
+          '<div class="kpi-label">' +
+          c.label +
+          "</div>" +
+          "</div>"
+        );
+      })
+      .join("");
+
+    renderLiveChart(seconds, data);
+    renderLiveLocations();
+  }
+
+  function renderLiveChart(seconds, data) {
+    var labels = seconds.map(function (t) {
+      return new Date(t * 1000).toLocaleTimeString();
+    });
+    if (liveChart) {
+      liveChart.data.labels = labels;
+      liveChart.data.datasets.forEach(function (ds) {
+        ds.data = data[ds.key];
+      });
+      liveChart.update("none");
+      return;
+    }
+    var line = function (key, label, color) {
+      return {
+        key: key,
+        label: label,
+        data: data[key],
+        borderColor: color,
+        backgroundColor: "transparent",
+        tension: 0.3,
+        pointRadius: 0,
+      };
+    };
+    var ctx = document.getElementById("live-chart").getContext("2d");
+    liveChart = new Chart(ctx, {
+      type: "line",
+      data: {
+        labels: labels,
+        datasets: [
+          line("requests", "Requests", "#777"),
+          line("challenges", "Challenges", "rgba(59, 130, 246, 1)"),
+          line("verified", "Verified", "rgba(43, 196, 172, 1)"),
+          line("failed", "Failed", "rgba(231, 76, 60, 1)"),
+        ],
+      },
+      options: {
+        responsive: true,
+        animation: false,
+        interaction: { mode: "index", intersect: false },
+        scales: {
+          x: { ticks: { maxTicksLimit: 6 } },
+          y: {
+            beginAtZero: true,
+            title: { display: true, text: "Per second" },
+          },
+        },
+      },
+    });
+  }
 
-    container.innerHTML = html;
+  // renderLiveLocations is the rolling map: requests per country over the
+  // live window.
+  function renderLiveLocations() {
+    var counts = {};
+    var total = 0;
+    Object.keys(liveBuckets).forEach(function (t) {
+      var locations = liveBuckets[t].locations;
+      Object.keys(locations).forEach(function (key) {
+        counts[key] = (counts[key] || 0) + locations[key];
+        total += locations[key];
+      });
+    });
+    var container = document.getElementById("live-locations");
+    if (!total) {
+      container.innerHTML =
+        '<div class="muted">No located requests in the last ' +
+        LIVE_SECONDS +
+        " seconds</div>";
+      return;
+    }
+    var entries = Object.keys(counts)
+      .map(function (key) {
+        var parts = key.split("/");
+        return {
+          continent: parts[0] || "Unknown",
+          country: parts[1],
+          count: counts[key],
+          percent: (counts[key] / total) * 100,
+        };
+      })
+      .sort(function (a, b) {
+        return b.count - a.count;
+      });
+    container.innerHTML = locationsHTML(entries);
   }
 
   function fmtNum(n) {
@@ -274,6 +796,30 @@
     return n.toLocaleString();
   }
 
+  function fmtPct(n) {
+    return (n || 0).toFixed(1) + "%";
+  }
+
+  function fmtSecs(n) {
+    if (!n) return "-";
+    if (n < 60) return n.toFixed(1) + " s";
+    return (n / 60).toFixed(1) + " min";
+  }
+
+  function escapeHTML(s) {
+    return String(s).replace(/[&<>"']/g, function (ch) {
+      return {
+        "&": "&amp;",
+        "<": "&lt;",
+        ">": "&gt;",
+        '"': "&quot;",
+        "'": "&#39;",
+      }[ch];
+    });
+  }
+
   // Initial load
   refreshDashboard();
+  startLive();
+  setInterval(renderLive, 1000);
 })();
@@ -0,0 +1,61 @@
+(function () {
+  const widget = document.querySelector('altcha-widget');
+  const form = document.getElementById('demo-form');
+  const algorithm = document.getElementById('algorithm');
+  const complexity = document.getElementById('complexity');
+  const result = document.getElementById('result');
+
+  function updateChallengeURL() {
+    const params = new URLSearchParams();
+    if (algorithm.value) params.set('algorithm', algorithm.value);
+    if (complexity.value) params.set('complexity', complexity.value);
+
+    const query = params.toString();
+    widget.setAttribute('challengeurl', query ? '/challenge?' + query : '/challenge');
+    if (typeof widget.reset === 'function') widget.reset();
+  }
+
+  algorithm.addEventListener('change', updateChallengeURL);
+  complexity.addEventListener('change', updateChallengeURL);
+
+  function row(label, value, cls) {
+    const tr = document.createElement('tr');
+    const th = document.createElement('th');
+    const td = document.createElement('td');
+    th.textContent = label;
+    td.textContent = value;
+    if (cls) td.className = cls;
+    tr.append(th, td);
+    return tr;
+  }
+
+  function render(data) {
+    const table = document.createElement('table');
+    table.append(
+      row('결과', data.verified ? '검증 성공' : '검증 실패', data.verified ? 'ok' : 'fail'),
+      row('/verify 응답', String(data.status)),
+      row('사유', data.reason),
+      row('재사용 여부', data.reason === 'replay' ? '재사용된 토큰' : '아니오'),
+      row('알고리즘', data.algorithm || '-'),
+      row('만료 시각', data.expires ? new Date(data.expires).toLocaleString() : '-'),
+    );
+    result.replaceChildren(table);
+    result.hidden = false;
+  }
+
+  form.addEventListener('submit', async function (ev) {
+    ev.preventDefault();
+
+    try {
+      const resp = await fetch(form.action, {
+        method: 'POST',
+        body: new URLSearchParams(new FormData(form)),
+      });
+      if (!resp.ok) throw new Error('HTTP ' + resp.status);
+      render(await resp.json());
+    } catch (err) {
+      result.textContent = '요청 실패: ' + err.message;
+      result.hidden = false;
+    }
+  });
+})();
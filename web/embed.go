@@ -0,0 +1,8 @@
+package web
+
+import "embed"
+
+// FS holds the static assets served by the demo, dashboard and gate servers.
+//
+//go:embed demo dashboard gate
+var FS embed.FS